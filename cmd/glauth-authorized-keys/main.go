@@ -0,0 +1,149 @@
+// Command glauth-authorized-keys prints the SSH public keys of a user stored in the GLAuth MySQL
+// database, for use as sshd's AuthorizedKeysCommand:
+//
+//	AuthorizedKeysCommand /usr/local/bin/glauth-authorized-keys -config /etc/glauth-authorized-keys.env %u
+//	AuthorizedKeysCommandUser nobody
+//
+// The configuration file uses the same variables as example.env, plus REQUIRED_GROUP which, when set,
+// restricts logins to members of the named group, directly or through nested include groups.
+// Nothing is printed when the user is unknown, disabled or not a member of the required group.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+	"github.com/mateo08c/go-glauth-mysql/glauth"
+	"golang.org/x/crypto/ssh"
+)
+
+func main() {
+	config := flag.String("config", "/etc/glauth-authorized-keys.env", "configuration file")
+	timeout := flag.Duration("timeout", 10*time.Second, "maximum time spent querying the database")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %s [-config file] [-timeout duration] user\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	log.SetFlags(0)
+	log.SetPrefix("glauth-authorized-keys: ")
+
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	env, err := godotenv.Read(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	client, err := glauth.New(&glauth.Context{
+		Username: env["DB_USERNAME"],
+		Password: env["DB_PASSWORD"],
+		Hostname: env["DB_HOSTNAME"],
+		Port:     env["DB_PORT"],
+		Database: env["DB_NAME"],
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	keys, err := authorizedKeys(client.WithContext(ctx), flag.Arg(0), env["REQUIRED_GROUP"])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, k := range keys {
+		fmt.Println(k)
+	}
+}
+
+// authorizedKeys returns the keys of the user in authorized_keys format, unchanged so that the
+// options restricting them reach sshd
+func authorizedKeys(client *glauth.Glauth, name, requiredGroup string) ([]string, error) {
+	user, err := client.GetUserByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, fmt.Errorf("user %s is disabled", name)
+	}
+
+	if requiredGroup != "" {
+		member, err := memberOf(client, name, requiredGroup)
+		if err != nil {
+			return nil, err
+		}
+
+		if !member {
+			return nil, fmt.Errorf("user %s is not a member of %s", name, requiredGroup)
+		}
+	}
+
+	keys, skipped := authorizedKeyLines(user.SSHKeys)
+	for _, k := range skipped {
+		log.Printf("skipping invalid key of %s: %s", name, k)
+	}
+
+	return keys, nil
+}
+
+// authorizedKeyLines returns the keys of the sshkeys column as stored, with their options, and
+// the parts which are not valid authorized_keys lines. Keys are stored comma separated, so a
+// key whose options contain commas spans several parts: a part which does not parse is tried
+// again joined with the following ones, rather than printing the key without its first options.
+func authorizedKeyLines(sshKeys string) (keys, skipped []string) {
+	var pending string
+	for _, k := range strings.Split(sshKeys, ",") {
+		line := strings.TrimSpace(k)
+		if pending != "" {
+			line = pending + "," + line
+		}
+
+		if line == "" {
+			continue
+		}
+
+		_, _, _, rest, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil || strings.TrimSpace(string(rest)) != "" {
+			pending = line
+			continue
+		}
+
+		keys = append(keys, line)
+		pending = ""
+	}
+
+	if pending != "" {
+		skipped = append(skipped, pending)
+	}
+
+	return keys, skipped
+}
+
+// memberOf reports whether the user belongs to the group through its primary group, its other
+// groups or, transitively, the groups including them
+func memberOf(client *glauth.Glauth, name, group string) (bool, error) {
+	g, err := client.GetGroupByName(group)
+	if err != nil {
+		if errors.Is(err, glauth.ErrGroupNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return client.IsMember(name, g.GIDNumber)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/joho/godotenv"
+	"github.com/mateo08c/go-glauth-mysql/glauth"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"golang.org/x/crypto/ssh"
+)
+
+func newClient(t *testing.T) *glauth.Glauth {
+	t.Helper()
+
+	// the .env file of the repository root, like the library tests
+	_ = godotenv.Load("../../.env")
+
+	client, err := glauth.New(&glauth.Context{
+		Username: os.Getenv("DB_USERNAME"),
+		Password: os.Getenv("DB_PASSWORD"),
+		Hostname: os.Getenv("DB_HOSTNAME"),
+		Port:     os.Getenv("DB_PORT"),
+		Database: os.Getenv("DB_NAME"),
+	})
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	return client
+}
+
+// newTestGroups creates n groups named prefix-i with the GIDs base+i, they are deleted at the end of the test
+func newTestGroups(t *testing.T, client *glauth.Glauth, prefix string, base, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		gid := base + i
+		err := client.CreateGroup(&ressources.CreateGroup{Name: fmt.Sprintf("%s-%d", prefix, i), GIDNumber: gid})
+		if err != nil {
+			t.Fatalf("Failed to create group %s-%d: %v", prefix, i, err)
+		}
+		t.Cleanup(func() { client.DeleteGroup(gid) })
+	}
+}
+
+func TestAuthorizedKeys(t *testing.T) {
+	client := newClient(t)
+
+	// 985000 includes 985001 which includes 985002, an other group of the user
+	newTestGroups(t, client, "test-authkeys", 985000, 4)
+
+	for _, ig := range [][2]int{{985001, 985002}, {985000, 985001}} {
+		err := client.AddIncludeGroup(ig[0], ig[1])
+		if err != nil {
+			t.Fatalf("Failed to add include group: %v", err)
+		}
+	}
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " test@authkeys"
+
+	err = client.CreateUser(&ressources.CreateUser{
+		Name:         "test-authkeys",
+		UIDNumber:    985000,
+		PrimaryGroup: 985003,
+		OtherGroups:  []int{985002},
+		SSHKeys:      key,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer client.DeleteUser(985000)
+
+	for _, group := range []string{"", "test-authkeys-3", "test-authkeys-2", "test-authkeys-0"} {
+		keys, err := authorizedKeys(client, "test-authkeys", group)
+		if err != nil {
+			t.Fatalf("Failed to get keys with required group %q: %v", group, err)
+		}
+
+		if len(keys) != 1 || keys[0] != key {
+			t.Fatalf("Expected key %s, got %v", key, keys)
+		}
+	}
+
+	_, err = authorizedKeys(client, "test-authkeys", "test-authkeys-missing")
+	if err == nil {
+		t.Fatal("Expected an error for a missing required group")
+	}
+
+	err = client.RemoveIncludeGroup(985001, 985002)
+	if err != nil {
+		t.Fatalf("Failed to remove include group: %v", err)
+	}
+
+	_, err = authorizedKeys(client, "test-authkeys", "test-authkeys-0")
+	if err == nil {
+		t.Fatal("Expected an error once the include chain is broken")
+	}
+
+	disabled := true
+	err = client.UpdateUser("test-authkeys", &ressources.UpdateUser{Disabled: &disabled})
+	if err != nil {
+		t.Fatalf("Failed to disable user: %v", err)
+	}
+
+	_, err = authorizedKeys(client, "test-authkeys", "")
+	if err == nil {
+		t.Fatal("Expected an error for a disabled user")
+	}
+}
+
+func TestAuthorizedKeyLines(t *testing.T) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub)))
+
+	restricted := `command="/bin/false" ` + key + " restricted"
+	options := `no-pty,from="10.0.0.1,10.0.0.2" ` + key + " options"
+
+	keys, skipped := authorizedKeyLines(key + " plain," + restricted + ", " + options + ",not a key")
+	if fmt.Sprint(keys) != fmt.Sprint([]string{key + " plain", restricted, options}) {
+		t.Fatalf("Expected the keys with their options, got %q", keys)
+	}
+
+	if len(skipped) != 1 || skipped[0] != "not a key" {
+		t.Fatalf("Expected the invalid key to be skipped, got %q", skipped)
+	}
+}
@@ -0,0 +1,171 @@
+package glauth
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/go-sql-driver/mysql"
+	"gorm.io/gorm/clause"
+)
+
+type AllocationStrategy int
+
+const (
+	// AllocateMonotonic hands out the highest id in use in the range plus one
+	AllocateMonotonic AllocationStrategy = iota
+	// AllocateFillGaps hands out the lowest free id in the range, reusing freed ids
+	AllocateFillGaps
+)
+
+// IDPolicy describes how UIDs or GIDs are allocated when none is given explicitly
+type IDPolicy struct {
+	Min      int                // first id of the range
+	Max      int                // last id of the range, inclusive; 0 means unbounded
+	Strategy AllocationStrategy // how the next id is picked in the range
+	Reserved []int              // ids the allocator never hands out
+}
+
+var (
+	DefaultUserIDPolicy  = IDPolicy{Min: 20000}
+	DefaultGroupIDPolicy = IDPolicy{Min: 10000}
+)
+
+// Contains reports whether id lies within the policy range
+func (p *IDPolicy) Contains(id int) bool {
+	return id >= p.Min && (p.Max == 0 || id <= p.Max)
+}
+
+func (p *IDPolicy) reserved(id int) bool {
+	for _, r := range p.Reserved {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	allocationLockTimeout = 10 // seconds to wait for the allocation lock
+	allocationRetries     = 5  // attempts made by retryAllocation
+)
+
+var (
+	ErrAllocationLockTimeout = errors.New("timed out waiting for the id allocation lock")
+
+	// errAllocationConflict is returned when an allocated id turns out to be taken; it is retried.
+	errAllocationConflict = errors.New("id allocation conflict")
+)
+
+// lockAllocation acquires a MySQL named lock serializing the allocation of the given
+// column across goroutines and processes sharing the database. The lock is tied to the
+// connection, so it must be taken inside a transaction and released before the
+// transaction ends; the locking read in FindNextUserID and FindNextGroupID then waits
+// for the uncommitted row of the previous holder.
+func (g *Glauth) lockAllocation(column string) (func(), error) {
+	release, acquired, err := g.getLock(column)
+	if err != nil {
+		return nil, err
+	}
+
+	if !acquired {
+		return nil, ErrAllocationLockTimeout
+	}
+
+	return release, nil
+}
+
+// getLock acquires the MySQL named lock of the database with the given name, waiting at most
+// allocationLockTimeout. It must be taken inside a transaction, see lockAllocation.
+func (g *Glauth) getLock(name string) (release func(), acquired bool, err error) {
+	name = "glauth:" + g.context.Database + ":" + name
+
+	var res sql.NullInt64
+	err = g.db.Raw("SELECT GET_LOCK(?, ?)", name, allocationLockTimeout).Scan(&res).Error
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !res.Valid || res.Int64 != 1 {
+		return nil, false, nil
+	}
+
+	return func() {
+		var released sql.NullInt64
+		g.db.Raw("SELECT RELEASE_LOCK(?)", name).Scan(&released)
+	}, true, nil
+}
+
+// nextID returns the next id of column allocated according to p. The rows read are locked,
+// so inside a transaction concurrent uncommitted rows are waited for.
+func (g *Glauth) nextID(table, column string, p *IDPolicy) (int, error) {
+	q := g.db.Table(table).Clauses(clause.Locking{Strength: "UPDATE"}).Where(column+" >= ?", p.Min)
+	if p.Max != 0 {
+		q = q.Where(column+" <= ?", p.Max)
+	}
+
+	var used []int
+	var err error
+	if p.Strategy == AllocateFillGaps {
+		err = q.Order(column).Pluck(column, &used).Error
+	} else {
+		err = q.Order(column+" desc").Limit(1).Pluck(column, &used).Error
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	id := p.Min
+	if p.Strategy != AllocateFillGaps && len(used) > 0 {
+		id = used[0] + 1
+	}
+
+	taken := make(map[int]bool, len(used))
+	if p.Strategy == AllocateFillGaps {
+		for _, u := range used {
+			taken[u] = true
+		}
+	}
+
+	for taken[id] || p.reserved(id) {
+		id++
+	}
+
+	if !p.Contains(id) {
+		return 0, &RangeError{Exhausted: true, Min: p.Min, Max: p.Max}
+	}
+
+	return id, nil
+}
+
+// retryAllocation runs fn again when it fails because of a concurrent allocation:
+// duplicate keys, deadlocks and lock wait timeouts. Inside a caller's transaction the
+// error is returned as is, since the whole transaction has to be retried.
+func (g *Glauth) retryAllocation(fn func() error) error {
+	var err error
+	for i := 0; i < allocationRetries; i++ {
+		err = fn()
+		if err == nil || g.inTx || !isAllocationConflict(err) {
+			return err
+		}
+	}
+
+	return err
+}
+
+func isAllocationConflict(err error) bool {
+	if errors.Is(err, errAllocationConflict) {
+		return true
+	}
+
+	var me *mysql.MySQLError
+	if errors.As(err, &me) {
+		switch me.Number {
+		case 1062, // ER_DUP_ENTRY
+			1205, // ER_LOCK_WAIT_TIMEOUT
+			1213: // ER_LOCK_DEADLOCK
+			return true
+		}
+	}
+
+	return false
+}
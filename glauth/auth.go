@@ -0,0 +1,146 @@
+package glauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+)
+
+// otpLength is the length of the TOTP code GLAuth expects appended to the password
+const otpLength = 6
+
+type AuthReason string
+
+const (
+	AuthUnknownUser AuthReason = "unknown_user" // no user has this name
+	AuthBadPassword AuthReason = "bad_password" // the password does not match
+	AuthDisabled    AuthReason = "disabled"     // the user is disabled
+	AuthOTPRequired AuthReason = "otp_required" // the user has an OTP secret but no code was given
+	AuthOTPInvalid  AuthReason = "otp_invalid"  // the OTP code does not match
+)
+
+var (
+	ErrUnknownUser  = errors.New("unknown user")
+	ErrBadPassword  = errors.New("bad password")
+	ErrUserDisabled = errors.New("user is disabled")
+	ErrOTPRequired  = errors.New("otp code required")
+	ErrOTPInvalid   = errors.New("invalid otp code")
+)
+
+// AuthError is returned by Authenticate, Reason tells why the credentials were refused.
+// It wraps the Err* sentinel matching the reason.
+type AuthError struct {
+	Name   string
+	Reason AuthReason
+}
+
+func (e *AuthError) Error() string {
+	return "authentication of " + e.Name + " failed: " + e.Unwrap().Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	switch e.Reason {
+	case AuthUnknownUser:
+		return ErrUnknownUser
+	case AuthDisabled:
+		return ErrUserDisabled
+	case AuthOTPRequired:
+		return ErrOTPRequired
+	case AuthOTPInvalid:
+		return ErrOTPInvalid
+	default:
+		return ErrBadPassword
+	}
+}
+
+// Authenticate checks the credentials the way GLAuth does on bind and returns the user on success.
+// When the user has an OTP secret the code is taken from otp or, when otp is empty, from the last
+// six characters of password as GLAuth expects it.
+func (g *Glauth) Authenticate(name, password string, otp string) (*ressources.User, error) {
+	var user models.User
+	err := g.db.Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &AuthError{Name: name, Reason: AuthUnknownUser}
+		}
+		return nil, err
+	}
+
+	if user.Disabled {
+		return nil, &AuthError{Name: name, Reason: AuthDisabled}
+	}
+
+	if user.OTPSecret != "" && otp == "" && len(password) > otpLength {
+		if _, ok := checkPassword(&user, password[:len(password)-otpLength]); ok {
+			otp = password[len(password)-otpLength:]
+			password = password[:len(password)-otpLength]
+		}
+	}
+
+	scheme, ok := checkPassword(&user, password)
+	if !ok {
+		return nil, &AuthError{Name: name, Reason: AuthBadPassword}
+	}
+
+	if user.OTPSecret != "" {
+		if otp == "" {
+			return nil, &AuthError{Name: name, Reason: AuthOTPRequired}
+		}
+
+		if !totp.Validate(otp, user.OTPSecret) {
+			return nil, &AuthError{Name: name, Reason: AuthOTPInvalid}
+		}
+	}
+
+	if scheme == ressources.PasswordSchemeSHA256 && g.context.RehashSHA256 {
+		g.rehashPassword(&user, password)
+	}
+
+	return g.userModelToResource(&user)
+}
+
+// rehashPassword rewrites a password that matched passsha256 to bcrypt. The update only applies if
+// the stored hash is still the one that matched, so a concurrent password change is not overwritten.
+func (g *Glauth) rehashPassword(u *models.User, password string) {
+	pass, err := g.hashPassword(password, ressources.PasswordSchemeBCrypt)
+	if err != nil {
+		return
+	}
+
+	res := g.db.Table("users").
+		Where("id = ? AND passsha256 = ?", u.ID, u.PassSHA256).
+		Updates(pass.columns())
+	if res.Error != nil || res.RowsAffected == 0 {
+		return
+	}
+
+	u.PassSHA256 = pass.SHA256
+	u.PassBCrypt = pass.BCrypt
+}
+
+// checkPassword compares password with the stored hashes and returns the scheme that matched
+func checkPassword(u *models.User, password string) (ressources.PasswordScheme, bool) {
+	if u.PassSHA256 != "" {
+		sum := sha256.Sum256([]byte(password))
+		if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(strings.ToLower(u.PassSHA256))) == 1 {
+			return ressources.PasswordSchemeSHA256, true
+		}
+	}
+
+	if u.PassBCrypt != "" {
+		hash, err := hex.DecodeString(u.PassBCrypt)
+		if err == nil && bcrypt.CompareHashAndPassword(hash, []byte(password)) == nil {
+			return ressources.PasswordSchemeBCrypt, true
+		}
+	}
+
+	return ressources.PasswordSchemeDefault, false
+}
@@ -1,6 +1,12 @@
 package glauth
 
-import "fmt"
+import (
+	"fmt"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm/logger"
+)
 
 type Context struct {
 	Username string
@@ -8,8 +14,73 @@ type Context struct {
 	Hostname string
 	Port     string
 	Database string
+
+	UserIDs  *IDPolicy // UID allocation policy, DefaultUserIDPolicy when nil; explicit UIDs are only checked against it when set
+	GroupIDs *IDPolicy // GID allocation policy, DefaultGroupIDPolicy when nil
+
+	PasswordScheme ressources.PasswordScheme // scheme used to store passwords, SHA256 when unset
+	BCryptCost     int                       // bcrypt cost, bcrypt.DefaultCost when unset
+
+	// RehashSHA256 makes Authenticate rewrite a password that matched passsha256 to bcrypt and clear
+	// passsha256, so that the directory migrates to bcrypt over time. A failed rewrite does not fail
+	// the authentication and is attempted again on the next one.
+	RehashSHA256 bool
+
+	PasswordPolicy PasswordPolicy // policy passwords must satisfy when they are set, none when nil
+
+	SSHKeyPolicy *SSHKeyPolicy // policy SSH public keys must satisfy, DefaultSSHKeyPolicy when nil
+
+	CustAttrSchema CustAttrSchema // schema custom attributes must match when they are written, none when nil
+
+	// MaxIncludeDepth is the maximum number of include relationships in a chain of nested groups
+	// AddIncludeGroup accepts, unlimited when 0
+	MaxIncludeDepth int
+
+	Logger logger.Interface // logger of the SQL queries, silent when nil
 }
 
 func (c *Context) Dsn() string {
 	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", c.Username, c.Password, c.Hostname, c.Port, c.Database)
 }
+
+func (c *Context) passwordScheme() ressources.PasswordScheme {
+	if c.PasswordScheme != ressources.PasswordSchemeDefault {
+		return c.PasswordScheme
+	}
+	return ressources.PasswordSchemeSHA256
+}
+
+func (c *Context) bcryptCost() int {
+	if c.BCryptCost != 0 {
+		return c.BCryptCost
+	}
+	return bcrypt.DefaultCost
+}
+
+func (c *Context) sshKeyPolicy() *SSHKeyPolicy {
+	if c.SSHKeyPolicy != nil {
+		return c.SSHKeyPolicy
+	}
+	return &DefaultSSHKeyPolicy
+}
+
+func (c *Context) userIDPolicy() *IDPolicy {
+	if c.UserIDs != nil {
+		return c.UserIDs
+	}
+	return &DefaultUserIDPolicy
+}
+
+func (c *Context) groupIDPolicy() *IDPolicy {
+	if c.GroupIDs != nil {
+		return c.GroupIDs
+	}
+	return &DefaultGroupIDPolicy
+}
+
+func (c *Context) logger() logger.Interface {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return logger.Default.LogMode(logger.Silent)
+}
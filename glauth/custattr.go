@@ -0,0 +1,218 @@
+package glauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// GetCustAttr returns the decoded custom attributes of the user
+func (g *Glauth) GetCustAttr(name string) (map[string]interface{}, error) {
+	var user models.User
+	err := g.db.Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &UserError{Name: name, Err: ErrUserNotFound}
+		}
+		return nil, err
+	}
+
+	return decodeCustAttr(user.CustAttr)
+}
+
+// GetCustAttrAs decodes the custom attributes of the user into a T, typically a struct with json tags
+func GetCustAttrAs[T any](g *Glauth, name string) (*T, error) {
+	var user models.User
+	err := g.db.Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &UserError{Name: name, Err: ErrUserNotFound}
+		}
+		return nil, err
+	}
+
+	v := new(T)
+	if user.CustAttr == "" {
+		return v, nil
+	}
+
+	err = json.Unmarshal([]byte(user.CustAttr), v)
+	if err != nil {
+		return nil, invalidCustAttr(err)
+	}
+
+	return v, nil
+}
+
+// reservedCustAttrs are the custom attributes managed by the library, which the generic accessors
+// refuse to write and replacing the custom attributes keeps
+var reservedCustAttrs = []string{RecoveryCodesAttr}
+
+func checkCustAttrKey(key string) error {
+	for _, r := range reservedCustAttrs {
+		if key == r {
+			return fmt.Errorf("%w: %s is reserved", ErrInvalidCustAttr, key)
+		}
+	}
+	return nil
+}
+
+// keepReservedCustAttrs replaces the reserved attributes of attrs with the ones of current
+func keepReservedCustAttrs(attrs, current map[string]interface{}) {
+	for _, r := range reservedCustAttrs {
+		delete(attrs, r)
+		if v, ok := current[r]; ok {
+			attrs[r] = v
+		}
+	}
+}
+
+// SetCustAttr sets one custom attribute of the user, value being encoded to JSON
+func (g *Glauth) SetCustAttr(name, key string, value interface{}) error {
+	err := checkCustAttrKey(key)
+	if err != nil {
+		return err
+	}
+
+	// round trip the value so that attrs only ever hold JSON types
+	b, err := json.Marshal(value)
+	if err != nil {
+		return invalidCustAttr(err)
+	}
+
+	var v interface{}
+	err = json.Unmarshal(b, &v)
+	if err != nil {
+		return invalidCustAttr(err)
+	}
+
+	return g.updateCustAttr(name, func(attrs map[string]interface{}) error {
+		attrs[key] = v
+		return nil
+	})
+}
+
+// DeleteCustAttr removes one custom attribute of the user
+func (g *Glauth) DeleteCustAttr(name, key string) error {
+	err := checkCustAttrKey(key)
+	if err != nil {
+		return err
+	}
+
+	return g.updateCustAttr(name, func(attrs map[string]interface{}) error {
+		delete(attrs, key)
+		return nil
+	})
+}
+
+// PatchCustAttr applies a JSON merge patch (RFC 7386) to the custom attributes of the user:
+// members of patch replace the ones of the attributes, objects are merged recursively and
+// null members are removed
+func (g *Glauth) PatchCustAttr(name string, patch []byte) error {
+	var p map[string]interface{}
+	err := json.Unmarshal(patch, &p)
+	if err != nil {
+		return invalidCustAttr(err)
+	}
+
+	if p == nil {
+		return invalidCustAttr(errors.New("merge patch must be a JSON object"))
+	}
+
+	for k := range p {
+		err = checkCustAttrKey(k)
+		if err != nil {
+			return err
+		}
+	}
+
+	return g.updateCustAttr(name, func(attrs map[string]interface{}) error {
+		mergePatch(attrs, p)
+		return nil
+	})
+}
+
+// mergePatch applies patch to target as described by RFC 7386 and returns the result.
+// target is modified in place when it is an object.
+func mergePatch(target interface{}, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+			continue
+		}
+
+		t[k] = mergePatch(t[k], v)
+	}
+
+	return t
+}
+
+// updateCustAttr decodes the user's custom attributes, applies fn and stores the result.
+// The user row is locked for the duration of the transaction, so concurrent updates are not lost.
+func (g *Glauth) updateCustAttr(name string, fn func(attrs map[string]interface{}) error) error {
+	return g.Transaction(func(tx *Glauth) error {
+		var user models.User
+		err := tx.db.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(&user).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &UserError{Name: name, Err: ErrUserNotFound}
+			}
+			return err
+		}
+
+		attrs, err := decodeCustAttr(user.CustAttr)
+		if err != nil {
+			return err
+		}
+
+		err = fn(attrs)
+		if err != nil {
+			return err
+		}
+
+		err = tx.validateCustAttr(attrs)
+		if err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(attrs)
+		if err != nil {
+			return invalidCustAttr(err)
+		}
+
+		return tx.db.Table("users").Where("id = ?", user.ID).Update("custattr", string(b)).Error
+	})
+}
+
+// decodeCustAttr decodes a custattr column, an empty one being an empty object
+func decodeCustAttr(s string) (map[string]interface{}, error) {
+	attrs := make(map[string]interface{})
+	if s == "" {
+		return attrs, nil
+	}
+
+	err := json.Unmarshal([]byte(s), &attrs)
+	if err != nil {
+		return nil, invalidCustAttr(err)
+	}
+
+	if attrs == nil {
+		attrs = make(map[string]interface{})
+	}
+
+	return attrs, nil
+}
@@ -0,0 +1,94 @@
+package glauth
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+var (
+	ErrUserNotFound       = errors.New("user not found")
+	ErrGroupNotFound      = errors.New("group not found")
+	ErrDuplicateName      = errors.New("name already exists")
+	ErrDuplicateUID       = errors.New("uid already exists")
+	ErrDuplicateGID       = errors.New("gid already exists")
+	ErrInvalidCustAttr    = errors.New("invalid custom attributes")
+	ErrGroupInUse         = errors.New("group is in use")
+	ErrPrimaryInOtherList = errors.New("primary group cannot be in the other groups")
+	ErrIDRangeExhausted   = errors.New("id range exhausted")
+	ErrIDOutOfRange       = errors.New("id out of range")
+	ErrIDReserved         = errors.New("id reserved")
+)
+
+// UserError describes the user an error relates to, e.g. ErrUserNotFound, ErrDuplicateName or
+// ErrDuplicateUID, or a more detailed error such as a RangeError or an SSHKeyError.
+type UserError struct {
+	Name      string // user name, if known
+	UIDNumber int    // user UID, if known
+	Err       error
+}
+
+func (e *UserError) Error() string {
+	if e.Name != "" {
+		return "user " + e.Name + ": " + e.Err.Error()
+	}
+	if e.UIDNumber == 0 {
+		return e.Err.Error()
+	}
+	return "user with UID " + strconv.Itoa(e.UIDNumber) + ": " + e.Err.Error()
+}
+
+func (e *UserError) Unwrap() error {
+	return e.Err
+}
+
+// GroupError describes the group an error relates to: ErrGroupNotFound, ErrDuplicateName,
+// ErrDuplicateGID or ErrGroupInUse.
+type GroupError struct {
+	Name      string // group name, if known
+	GIDNumber int    // group GID, if known
+	Err       error
+}
+
+func (e *GroupError) Error() string {
+	if e.Name != "" {
+		return "group " + e.Name + ": " + e.Err.Error()
+	}
+	return "group with GID " + strconv.Itoa(e.GIDNumber) + ": " + e.Err.Error()
+}
+
+func (e *GroupError) Unwrap() error {
+	return e.Err
+}
+
+// RangeError is returned when an id range has no free id left or an id lies outside of it
+type RangeError struct {
+	ID        int  // offending id, unset when the range is exhausted
+	Exhausted bool // whether the range has no free id left
+	Min       int
+	Max       int
+}
+
+func (e *RangeError) Error() string {
+	r := strconv.Itoa(e.Min) + "-"
+	if e.Max != 0 {
+		r += strconv.Itoa(e.Max)
+	}
+
+	if e.Exhausted {
+		return "id range " + r + " is exhausted"
+	}
+	return "id " + strconv.Itoa(e.ID) + " is outside of range " + r
+}
+
+func (e *RangeError) Unwrap() error {
+	if e.Exhausted {
+		return ErrIDRangeExhausted
+	}
+	return ErrIDOutOfRange
+}
+
+// invalidCustAttr wraps a JSON decoding error with ErrInvalidCustAttr.
+func invalidCustAttr(err error) error {
+	return fmt.Errorf("%w: %w", ErrInvalidCustAttr, err)
+}
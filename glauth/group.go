@@ -5,6 +5,7 @@ import (
 	"github.com/mateo08c/go-glauth-mysql/glauth/models"
 	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 	"strconv"
 	"strings"
 )
@@ -13,6 +14,9 @@ func (g *Glauth) GetGroupByGID(gid int) (*ressources.Group, error) {
 	var group models.LDAPGroup
 	err := g.db.Where("gidnumber = ?", gid).Table("ldapgroups").First(&group).Error
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &GroupError{GIDNumber: gid, Err: ErrGroupNotFound}
+		}
 		return nil, err
 	}
 
@@ -27,6 +31,9 @@ func (g *Glauth) GetGroupByName(name string) (*ressources.Group, error) {
 	var group models.LDAPGroup
 	err := g.db.Where("name = ?", name).Table("ldapgroups").First(&group).Error
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &GroupError{Name: name, Err: ErrGroupNotFound}
+		}
 		return nil, err
 	}
 
@@ -63,13 +70,21 @@ func (g *Glauth) GetIncludeGroupsByIncludeGroupGID(gid int) ([]*ressources.Group
 }
 
 func (g *Glauth) CreateGroup(gr *ressources.CreateGroup) error {
+	return g.retryAllocation(func() error {
+		return g.Transaction(func(tx *Glauth) error {
+			return tx.createGroup(gr)
+		})
+	})
+}
+
+func (g *Glauth) createGroup(gr *ressources.CreateGroup) error {
 	exists, err := g.GroupExistByGID(gr.GIDNumber)
 	if err != nil {
 		return err
 	}
 
 	if exists {
-		return errors.New("group with GID " + strconv.Itoa(gr.GIDNumber) + " already exists")
+		return &GroupError{GIDNumber: gr.GIDNumber, Err: ErrDuplicateGID}
 	}
 
 	exists, err = g.GroupExistByName(gr.Name)
@@ -78,7 +93,7 @@ func (g *Glauth) CreateGroup(gr *ressources.CreateGroup) error {
 	}
 
 	if exists {
-		return errors.New("group with name " + gr.Name + " already exists")
+		return &GroupError{Name: gr.Name, Err: ErrDuplicateName}
 	}
 
 	group := &models.LDAPGroup{
@@ -87,6 +102,12 @@ func (g *Glauth) CreateGroup(gr *ressources.CreateGroup) error {
 	}
 
 	if gr.GIDNumber == 0 {
+		release, err := g.lockAllocation("gidnumber")
+		if err != nil {
+			return err
+		}
+		defer release()
+
 		id, err := g.FindNextGroupID()
 		if err != nil {
 			return err
@@ -97,6 +118,10 @@ func (g *Glauth) CreateGroup(gr *ressources.CreateGroup) error {
 			return err
 		}
 
+		if exists {
+			return errAllocationConflict
+		}
+
 		group.GIDNumber = id
 	}
 
@@ -108,75 +133,205 @@ func (g *Glauth) CreateGroup(gr *ressources.CreateGroup) error {
 	return nil
 }
 
+// UpdateGroup renames or renumbers the group. A new GID is cascaded to the primary and other groups
+// of the users and to the include group relationships in a single transaction.
 func (g *Glauth) UpdateGroup(name string, gr *ressources.UpdateGroup) error {
+	return g.Transaction(func(tx *Glauth) error {
+		_, err := tx.updateGroup(name, gr)
+		return err
+	})
+}
+
+// errDryRun rolls back the transaction of PreviewUpdateGroup
+var errDryRun = errors.New("dry run")
+
+// PreviewUpdateGroup returns the rows UpdateGroup would change, without changing them
+func (g *Glauth) PreviewUpdateGroup(name string, gr *ressources.UpdateGroup) (*ressources.GroupUpdatePreview, error) {
+	var preview *ressources.GroupUpdatePreview
+	err := g.Transaction(func(tx *Glauth) error {
+		var err error
+		preview, err = tx.updateGroup(name, gr)
+		if err != nil {
+			return err
+		}
+
+		return errDryRun
+	})
+	if !errors.Is(err, errDryRun) {
+		return nil, err
+	}
+
+	return preview, nil
+}
+
+func (g *Glauth) updateGroup(name string, gr *ressources.UpdateGroup) (*ressources.GroupUpdatePreview, error) {
 	var group models.LDAPGroup
-	err := g.db.Table("ldapgroups").Where("name = ?", name).First(&group).Error
+	err := g.db.Table("ldapgroups").Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(&group).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("group not found")
+			return nil, &GroupError{Name: name, Err: ErrGroupNotFound}
 		}
-		return err
+		return nil, err
 	}
 
-	if gr.Name != nil {
+	preview := &ressources.GroupUpdatePreview{Name: group.Name, GIDNumber: group.GIDNumber}
+
+	if gr.Name != nil && *gr.Name != group.Name {
+		exists, err := g.GroupExistByName(*gr.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			return nil, &GroupError{Name: *gr.Name, Err: ErrDuplicateName}
+		}
+
 		group.Name = *gr.Name
 	}
 
-	if gr.GIDNumber != nil {
+	if gr.GIDNumber != nil && *gr.GIDNumber != group.GIDNumber {
+		exists, err := g.GroupExistByGID(*gr.GIDNumber)
+		if err != nil {
+			return nil, err
+		}
+
+		if exists {
+			return nil, &GroupError{GIDNumber: *gr.GIDNumber, Err: ErrDuplicateGID}
+		}
+
+		err = g.renumberGroup(group.GIDNumber, *gr.GIDNumber, preview)
+		if err != nil {
+			return nil, err
+		}
+
 		group.GIDNumber = *gr.GIDNumber
 	}
 
 	err = g.db.Table("ldapgroups").Save(&group).Error
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return preview, nil
 }
 
-func (g *Glauth) DeleteGroup(gid int) error {
-	var group models.LDAPGroup
-	err := g.db.Table("ldapgroups").Where("gidnumber = ?", gid).First(&group).Error
+// renumberGroup replaces the GID of a group by a new one wherever users and include groups
+// reference it, recording the rows changed in preview
+func (g *Glauth) renumberGroup(oldGID, newGID int, preview *ressources.GroupUpdatePreview) error {
+	var users []*models.User
+	err := g.db.Table("users").Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("primarygroup = ? OR FIND_IN_SET(?, othergroups) > 0", oldGID, strconv.Itoa(oldGID)).
+		Order("uidnumber").
+		Find(&users).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("group not found")
-		}
 		return err
 	}
 
-	err = g.db.Table("ldapgroups").Delete(&group).Error
+	for _, u := range users {
+		if u.PrimaryGroup == oldGID {
+			preview.PrimaryUsers = append(preview.PrimaryUsers, u.Name)
+		}
+
+		others := parseGIDs(string(u.OtherGroups))
+		if !containsGID(others, oldGID) {
+			continue
+		}
+
+		preview.OtherUsers = append(preview.OtherUsers, u.Name)
+
+		// a deleted group may have left the new GID in the list
+		var renumbered []int
+		for _, gid := range others {
+			if gid == oldGID {
+				gid = newGID
+			}
+
+			if !containsGID(renumbered, gid) {
+				renumbered = append(renumbered, gid)
+			}
+		}
+
+		err = g.setOtherGroups(u, renumbered)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = g.db.Table("users").Where("primarygroup = ?", oldGID).Update("primarygroup", newGID).Error
 	if err != nil {
 		return err
 	}
 
-	//search for includegroups
 	var includeGroups []*models.IncludeGroup
-	err = g.db.Table("includegroups").Where("parentgroupid = ?", group.GIDNumber).Find(&includeGroups).Error
+	err = g.db.Table("includegroups").Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("parentgroupid = ? OR includegroupid = ?", oldGID, oldGID).
+		Order("id").
+		Find(&includeGroups).Error
 	if err != nil {
 		return err
 	}
 
 	for _, ig := range includeGroups {
-		err = g.db.Table("includegroups").Delete(&ig).Error
-		if err != nil {
-			return err
-		}
+		preview.IncludeGroups = append(preview.IncludeGroups, ressources.IncludeGroup{
+			ParentGID:  ig.ParentGroupID,
+			IncludeGID: ig.IncludeGroupID,
+		})
 	}
 
-	return nil
+	err = g.db.Table("includegroups").Where("parentgroupid = ?", oldGID).Update("parentgroupid", newGID).Error
+	if err != nil {
+		return err
+	}
+
+	return g.db.Table("includegroups").Where("includegroupid = ?", oldGID).Update("includegroupid", newGID).Error
 }
 
-func (g *Glauth) FindNextGroupID() (int, error) {
+// DeleteGroup deletes the group and its include group relationships in a single transaction
+func (g *Glauth) DeleteGroup(gid int) error {
+	return g.Transaction(func(tx *Glauth) error {
+		return tx.deleteGroup(gid)
+	})
+}
+
+func (g *Glauth) deleteGroup(gid int) error {
 	var group models.LDAPGroup
-	err := g.db.Table("ldapgroups").Order("gidnumber desc").First(&group).Error
+	err := g.db.Table("ldapgroups").Where("gidnumber = ?", gid).First(&group).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return 10000, nil
+			return &GroupError{GIDNumber: gid, Err: ErrGroupNotFound}
 		}
-		return 0, err
+		return err
+	}
+
+	inUse, err := g.GroupInUse(gid)
+	if err != nil {
+		return err
+	}
+
+	if inUse {
+		return &GroupError{Name: group.Name, GIDNumber: gid, Err: ErrGroupInUse}
+	}
+
+	err = g.db.Table("ldapgroups").Delete(&group).Error
+	if err != nil {
+		return err
+	}
+
+	//delete includegroups in which the group is either the parent or the included group
+	err = g.db.Table("includegroups").
+		Where("parentgroupid = ? OR includegroupid = ?", group.GIDNumber, group.GIDNumber).
+		Delete(&models.IncludeGroup{}).Error
+	if err != nil {
+		return err
 	}
 
-	return group.GIDNumber + 1, nil
+	return nil
+}
+
+// FindNextGroupID returns the next free GID according to the client's GroupIDs policy, locking
+// the rows it reads like FindNextUserID
+func (g *Glauth) FindNextGroupID() (int, error) {
+	return g.nextID("ldapgroups", "gidnumber", g.context.groupIDPolicy())
 }
 
 func (g *Glauth) GroupExistByGID(gid int) (bool, error) {
@@ -192,6 +347,19 @@ func (g *Glauth) GroupExistByGID(gid int) (bool, error) {
 	return true, nil
 }
 
+// GroupInUse reports whether a user references the group as its primary group or in its other groups
+func (g *Glauth) GroupInUse(gid int) (bool, error) {
+	var count int64
+	err := g.db.Table("users").
+		Where("primarygroup = ? OR FIND_IN_SET(?, othergroups) > 0", gid, strconv.Itoa(gid)).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
 func (g *Glauth) GroupExistByName(name string) (bool, error) {
 	var group models.LDAPGroup
 	err := g.db.Where("name = ?", name).Table("ldapgroups").First(&group).Error
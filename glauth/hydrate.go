@@ -0,0 +1,184 @@
+package glauth
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+)
+
+// hydrateBatchSize bounds the number of users hydrated together, and so the size of the IN lists
+const hydrateBatchSize = 1000
+
+// userModelToResource hydrates a single user, see usersModelToResources
+func (g *Glauth) userModelToResource(u *models.User) (*ressources.User, error) {
+	res, err := g.usersModelToResources([]*models.User{u})
+	if err != nil {
+		return nil, err
+	}
+
+	return res[0], nil
+}
+
+// usersModelToResources converts users to resources, resolving their primary group, other groups,
+// the groups including their primary group and their capabilities. Every batch of users costs the
+// same three queries whatever its size.
+func (g *Glauth) usersModelToResources(users []*models.User) ([]*ressources.User, error) {
+	res := make([]*ressources.User, 0, len(users))
+	for start := 0; start < len(users); start += hydrateBatchSize {
+		end := start + hydrateBatchSize
+		if end > len(users) {
+			end = len(users)
+		}
+
+		batch, err := g.hydrateBatch(users[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, batch...)
+	}
+
+	return res, nil
+}
+
+func (g *Glauth) hydrateBatch(users []*models.User) ([]*ressources.User, error) {
+	var primaryGIDs, uids []int
+	gids := make(map[int]bool)
+	otherGIDs := make(map[*models.User][]int, len(users))
+	for _, u := range users {
+		uids = append(uids, u.UIDNumber)
+		primaryGIDs = append(primaryGIDs, u.PrimaryGroup)
+		gids[u.PrimaryGroup] = true
+
+		otherGIDs[u] = parseGIDs(string(u.OtherGroups))
+		for _, gid := range otherGIDs[u] {
+			gids[gid] = true
+		}
+	}
+
+	// groups including the primary groups, in the order of the includegroups table
+	if err := g.canceled(); err != nil {
+		return nil, err
+	}
+
+	var includeGroups []*models.IncludeGroup
+	err := g.db.Table("includegroups").Where("includegroupid IN ?", primaryGIDs).Order("id").Find(&includeGroups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	parents := make(map[int][]int)
+	for _, ig := range includeGroups {
+		parents[ig.IncludeGroupID] = append(parents[ig.IncludeGroupID], ig.ParentGroupID)
+		gids[ig.ParentGroupID] = true
+	}
+
+	// every group referenced
+	if err := g.canceled(); err != nil {
+		return nil, err
+	}
+
+	var gidList []int
+	for gid := range gids {
+		gidList = append(gidList, gid)
+	}
+
+	var groups []*models.LDAPGroup
+	err = g.db.Table("ldapgroups").Where("gidnumber IN ?", gidList).Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	groupsByGID := make(map[int]*models.LDAPGroup, len(groups))
+	for _, gr := range groups {
+		groupsByGID[gr.GIDNumber] = gr
+	}
+
+	// capabilities
+	if err := g.canceled(); err != nil {
+		return nil, err
+	}
+
+	var capabilities []*models.Capability
+	err = g.db.Table("capabilities").Where("userid IN ?", uids).Find(&capabilities).Error
+	if err != nil {
+		return nil, err
+	}
+
+	capsByUID := make(map[int][]*ressources.Capability)
+	for _, c := range capabilities {
+		capsByUID[c.UserID] = append(capsByUID[c.UserID], &ressources.Capability{
+			ID:     c.ID,
+			UserID: c.UserID,
+			Action: ressources.CapabilityAction(c.Action),
+			Object: c.Object,
+		})
+	}
+
+	res := make([]*ressources.User, 0, len(users))
+	for _, u := range users {
+		r := &ressources.User{
+			ID:            u.ID,
+			Name:          u.Name,
+			UIDNumber:     u.UIDNumber,
+			GivenName:     u.GivenName,
+			SN:            u.SN,
+			Mail:          u.Mail,
+			LoginShell:    u.LoginShell,
+			HomeDirectory: u.HomeDirectory,
+			Disabled:      u.Disabled,
+			PassSHA256:    u.PassSHA256,
+			PassBCrypt:    u.PassBCrypt,
+			OTPSecret:     u.OTPSecret,
+			Yubikey:       u.Yubikey,
+			SSHKeys:       u.SSHKeys,
+			CustAttr:      u.CustAttr,
+			Capabilities:  capsByUID[u.UIDNumber],
+		}
+
+		if pg, ok := groupsByGID[u.PrimaryGroup]; ok && u.PrimaryGroup != 0 {
+			r.PrimaryGroup = groupModelToResource(pg)
+		}
+
+		for _, gid := range append(otherGIDs[u], parents[u.PrimaryGroup]...) {
+			og, ok := groupsByGID[gid]
+			if !ok {
+				continue
+			}
+
+			if r.PrimaryGroup != nil && r.PrimaryGroup.GIDNumber == og.GIDNumber {
+				continue
+			}
+
+			gr := groupModelToResource(og)
+			if !GroupExistsInList(r.OtherGroups, gr) {
+				r.OtherGroups = append(r.OtherGroups, gr)
+			}
+		}
+
+		res = append(res, r)
+	}
+
+	return res, nil
+}
+
+func groupModelToResource(g *models.LDAPGroup) *ressources.Group {
+	return &ressources.Group{
+		ID:        g.ID,
+		Name:      g.Name,
+		GIDNumber: g.GIDNumber,
+	}
+}
+
+// parseGIDs parses the comma separated GIDs of the othergroups column, ignoring invalid entries
+func parseGIDs(s string) []int {
+	var gids []int
+	for _, id := range strings.Split(strings.Trim(s, ","), ",") {
+		if i, err := strconv.Atoi(strings.TrimSpace(id)); err == nil {
+			gids = append(gids, i)
+		}
+	}
+	return gids
+}
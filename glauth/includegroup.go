@@ -0,0 +1,392 @@
+package glauth
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrDuplicateIncludeGroup = errors.New("group already included")
+	ErrIncludeGroupNotFound  = errors.New("group not included")
+	ErrIncludeCycle          = errors.New("include group cycle")
+	ErrIncludeDepth          = errors.New("include group depth exceeded")
+	ErrIncludeLockTimeout    = errors.New("timed out waiting for the include groups lock")
+)
+
+// IncludeGroupError is returned when the relationship between a parent group and an included
+// group is already present (ErrDuplicateIncludeGroup) or missing (ErrIncludeGroupNotFound)
+type IncludeGroupError struct {
+	ParentGID  int // GID of the including group
+	IncludeGID int // GID of the included group
+	Err        error
+}
+
+func (e *IncludeGroupError) Error() string {
+	return "group with GID " + strconv.Itoa(e.IncludeGID) + " in group with GID " + strconv.Itoa(e.ParentGID) + ": " + e.Err.Error()
+}
+
+func (e *IncludeGroupError) Unwrap() error {
+	return e.Err
+}
+
+// CycleError is returned when including a group would make it a member of itself, and reported
+// by FindIncludeCycles for the cycles already in the database
+type CycleError struct {
+	Path []int // GIDs of the groups of the cycle, each one including the next; the first and last are the same
+}
+
+func (e *CycleError) Error() string {
+	return ErrIncludeCycle.Error() + ": " + gidPath(e.Path)
+}
+
+func (e *CycleError) Unwrap() error {
+	return ErrIncludeCycle
+}
+
+// DepthError is returned when including a group would make a chain of nested groups longer than
+// the client's MaxIncludeDepth
+type DepthError struct {
+	Path []int // GIDs of the groups of the longest chain, each one including the next
+	Max  int
+}
+
+func (e *DepthError) Error() string {
+	return ErrIncludeDepth.Error() + ": " + gidPath(e.Path) + " is deeper than " + strconv.Itoa(e.Max)
+}
+
+func (e *DepthError) Unwrap() error {
+	return ErrIncludeDepth
+}
+
+func gidPath(path []int) string {
+	var s []string
+	for _, gid := range path {
+		s = append(s, strconv.Itoa(gid))
+	}
+	return strings.Join(s, " -> ")
+}
+
+// AddIncludeGroup makes the parent group include the other one, so that the members of the
+// included group are also members of the parent group
+func (g *Glauth) AddIncludeGroup(parentGID, includeGID int) error {
+	return g.Transaction(func(tx *Glauth) error {
+		return tx.addIncludeGroup(parentGID, includeGID)
+	})
+}
+
+func (g *Glauth) addIncludeGroup(parentGID, includeGID int) error {
+	// a cycle may go through any group, so every addition is serialized. The lock is released
+	// before the transaction commits, so the graph is read with a locking read: it waits for the
+	// uncommitted row of the previous holder instead of missing it, like nextID does.
+	release, acquired, err := g.getLock("includegroups")
+	if err != nil {
+		return err
+	}
+
+	if !acquired {
+		return ErrIncludeLockTimeout
+	}
+	defer release()
+
+	err = g.lockGroups(parentGID, includeGID)
+	if err != nil {
+		return err
+	}
+
+	graph, err := g.loadIncludeGraph(true)
+	if err != nil {
+		return err
+	}
+
+	if containsGID(graph.children[parentGID], includeGID) {
+		return &IncludeGroupError{ParentGID: parentGID, IncludeGID: includeGID, Err: ErrDuplicateIncludeGroup}
+	}
+
+	// the new relationship closes a cycle if the parent is already nested in the included group
+	if path := graph.path(includeGID, parentGID); path != nil {
+		return &CycleError{Path: append([]int{parentGID}, path...)}
+	}
+
+	if max := g.context.MaxIncludeDepth; max > 0 {
+		up := graph.longest(parentGID, graph.parents)
+		for i, j := 0, len(up)-1; i < j; i, j = i+1, j-1 {
+			up[i], up[j] = up[j], up[i]
+		}
+
+		chain := append(up, graph.longest(includeGID, graph.children)...)
+		if len(chain)-1 > max {
+			return &DepthError{Path: chain, Max: max}
+		}
+	}
+
+	return g.db.Table("includegroups").Create(&models.IncludeGroup{
+		ParentGroupID:  parentGID,
+		IncludeGroupID: includeGID,
+	}).Error
+}
+
+// RemoveIncludeGroup removes the inclusion of a group in the parent group
+func (g *Glauth) RemoveIncludeGroup(parentGID, includeGID int) error {
+	return g.Transaction(func(tx *Glauth) error {
+		err := tx.lockGroups(parentGID, includeGID)
+		if err != nil {
+			return err
+		}
+
+		res := tx.db.Table("includegroups").
+			Where("parentgroupid = ? AND includegroupid = ?", parentGID, includeGID).
+			Delete(&models.IncludeGroup{})
+		if res.Error != nil {
+			return res.Error
+		}
+
+		if res.RowsAffected == 0 {
+			return &IncludeGroupError{ParentGID: parentGID, IncludeGID: includeGID, Err: ErrIncludeGroupNotFound}
+		}
+
+		return nil
+	})
+}
+
+// IncludeGroupExists reports whether the parent group directly includes the other one
+func (g *Glauth) IncludeGroupExists(parentGID, includeGID int) (bool, error) {
+	var count int64
+	err := g.db.Table("includegroups").
+		Where("parentgroupid = ? AND includegroupid = ?", parentGID, includeGID).
+		Count(&count).Error
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// ListIncludedGroups returns the groups the parent group directly includes, ordered by GID
+func (g *Glauth) ListIncludedGroups(parentGID int) ([]*ressources.Group, error) {
+	return g.includeGroups(parentGID, "parentgroupid", "includegroupid")
+}
+
+// ListParentGroups returns the groups directly including the group, ordered by GID
+func (g *Glauth) ListParentGroups(includeGID int) ([]*ressources.Group, error) {
+	return g.includeGroups(includeGID, "includegroupid", "parentgroupid")
+}
+
+// includeGroups returns the groups found in the other column of the includegroups rows where
+// column is gid
+func (g *Glauth) includeGroups(gid int, column, other string) ([]*ressources.Group, error) {
+	exists, err := g.GroupExistByGID(gid)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, &GroupError{GIDNumber: gid, Err: ErrGroupNotFound}
+	}
+
+	var groups []*models.LDAPGroup
+	err = g.db.Table("ldapgroups").
+		Select("ldapgroups.*").
+		Joins("JOIN includegroups ON includegroups."+other+" = ldapgroups.gidnumber").
+		Where("includegroups."+column+" = ?", gid).
+		Order("ldapgroups.gidnumber").
+		Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var resGroups []*ressources.Group
+	for _, gr := range groups {
+		resGroups = append(resGroups, groupModelToResource(gr))
+	}
+
+	return resGroups, nil
+}
+
+// FindIncludeCycles returns include group cycles of the database, such as the ones created by
+// other tools, each one starting with its lowest GID. Groups nested in each other are reported in
+// at least one cycle, but not every possible cycle through them is.
+func (g *Glauth) FindIncludeCycles() ([]*CycleError, error) {
+	graph, err := g.loadIncludeGraph(false)
+	if err != nil {
+		return nil, err
+	}
+
+	var gids []int
+	for gid := range graph.children {
+		gids = append(gids, gid)
+	}
+	sort.Ints(gids)
+
+	// depth first search, every edge to a group on the stack closes a cycle
+	var cycles []*CycleError
+	seen := make(map[string]bool)
+	done := make(map[int]bool)
+	var stack []int
+	onStack := make(map[int]int)
+
+	var visit func(gid int)
+	visit = func(gid int) {
+		onStack[gid] = len(stack)
+		stack = append(stack, gid)
+
+		for _, child := range graph.children[gid] {
+			if i, ok := onStack[child]; ok {
+				path := rotateCycle(stack[i:])
+				key := gidPath(path)
+				if !seen[key] {
+					seen[key] = true
+					cycles = append(cycles, &CycleError{Path: path})
+				}
+				continue
+			}
+
+			if !done[child] {
+				visit(child)
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		delete(onStack, gid)
+		done[gid] = true
+	}
+
+	for _, gid := range gids {
+		if !done[gid] {
+			visit(gid)
+		}
+	}
+
+	return cycles, nil
+}
+
+// rotateCycle returns the cycle made of the groups starting with its lowest GID, closed by
+// repeating it at the end
+func rotateCycle(groups []int) []int {
+	lowest := 0
+	for i, gid := range groups {
+		if gid < groups[lowest] {
+			lowest = i
+		}
+	}
+
+	path := append([]int(nil), groups[lowest:]...)
+	path = append(path, groups[:lowest]...)
+	return append(path, path[0])
+}
+
+// includeGraph holds the include group relationships, by GID
+type includeGraph struct {
+	children map[int][]int // groups included by a group
+	parents  map[int][]int // groups including a group
+}
+
+// loadIncludeGraph reads the include group relationships. With lock, the rows are read with a
+// locking read and stay locked for the rest of the transaction.
+func (g *Glauth) loadIncludeGraph(lock bool) (*includeGraph, error) {
+	q := g.db.Table("includegroups")
+	if lock {
+		q = q.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+
+	var rows []*models.IncludeGroup
+	err := q.Order("id").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+
+	graph := &includeGraph{children: make(map[int][]int), parents: make(map[int][]int)}
+	for _, r := range rows {
+		graph.children[r.ParentGroupID] = append(graph.children[r.ParentGroupID], r.IncludeGroupID)
+		graph.parents[r.IncludeGroupID] = append(graph.parents[r.IncludeGroupID], r.ParentGroupID)
+	}
+
+	return graph, nil
+}
+
+// path returns the shortest chain of groups from one group to a group it includes, possibly
+// indirectly, or nil when it does not include it. The chain of a group to itself is that group.
+func (ig *includeGraph) path(from, to int) []int {
+	prev := map[int]int{from: from}
+	queue := []int{from}
+	for len(queue) > 0 {
+		gid := queue[0]
+		queue = queue[1:]
+
+		if gid == to {
+			var path []int
+			for ; gid != from; gid = prev[gid] {
+				path = append([]int{gid}, path...)
+			}
+			return append([]int{from}, path...)
+		}
+
+		for _, next := range ig.children[gid] {
+			if _, ok := prev[next]; !ok {
+				prev[next] = gid
+				queue = append(queue, next)
+			}
+		}
+	}
+
+	return nil
+}
+
+// longest returns the longest chain of groups starting at gid and following next, which is
+// either children or parents. Existing cycles are not followed.
+func (ig *includeGraph) longest(gid int, next map[int][]int) []int {
+	memo := make(map[int][]int)
+	visiting := make(map[int]bool)
+
+	var walk func(gid int) []int
+	walk = func(gid int) []int {
+		if chain, ok := memo[gid]; ok {
+			return chain
+		}
+
+		visiting[gid] = true
+		var best []int
+		for _, n := range next[gid] {
+			if visiting[n] {
+				continue
+			}
+
+			if chain := walk(n); len(chain) > len(best) {
+				best = chain
+			}
+		}
+		visiting[gid] = false
+
+		memo[gid] = append([]int{gid}, best...)
+		return memo[gid]
+	}
+
+	return append([]int(nil), walk(gid)...)
+}
+
+// lockGroups locks the rows of the groups for the rest of the transaction, failing if one of
+// them does not exist. Rows are locked in GID order so that concurrent callers cannot deadlock.
+func (g *Glauth) lockGroups(gids ...int) error {
+	sorted := append([]int(nil), gids...)
+	sort.Ints(sorted)
+
+	for _, gid := range sorted {
+		var group models.LDAPGroup
+		err := g.db.Table("ldapgroups").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("gidnumber = ?", gid).First(&group).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &GroupError{GIDNumber: gid, Err: ErrGroupNotFound}
+			}
+			return err
+		}
+	}
+
+	return nil
+}
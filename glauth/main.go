@@ -1,19 +1,23 @@
 package glauth
 
 import (
+	"context"
+
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
-	"gorm.io/gorm/logger"
 )
 
 type Glauth struct {
 	context *Context
 	db      *gorm.DB
+	ctx     context.Context
+	inTx    bool
 }
 
 func New(c *Context) (*Glauth, error) {
 	g := &Glauth{
 		context: c,
+		ctx:     context.Background(),
 	}
 
 	err := g.connect()
@@ -24,16 +28,43 @@ func New(c *Context) (*Glauth, error) {
 	return g, nil
 }
 
+// WithContext returns a shallow copy of the client whose queries are bound to ctx,
+// so that cancellation, deadlines and request-scoped values reach the database driver.
+func (g *Glauth) WithContext(ctx context.Context) *Glauth {
+	c := *g
+	c.ctx = ctx
+	c.db = g.db.WithContext(ctx)
+	return &c
+}
+
 func (g *Glauth) connect() error {
 	mo := mysql.Open(g.context.Dsn())
 	db, err := gorm.Open(mo, &gorm.Config{
-		Logger: logger.Default.LogMode(logger.Silent),
+		Logger: g.context.logger(),
 	})
 	if err != nil {
 		return err
 	}
 
-	g.db = db
+	g.db = db.WithContext(g.ctx)
 
 	return nil
 }
+
+// Transaction runs fn in a single database transaction. Every call made through tx
+// is part of the transaction, which is committed when fn returns nil and rolled back
+// otherwise. Transactions may be nested, in which case savepoints are used.
+func (g *Glauth) Transaction(fn func(tx *Glauth) error) error {
+	return g.db.Transaction(func(db *gorm.DB) error {
+		tx := *g
+		tx.db = db
+		tx.inTx = true
+		return fn(&tx)
+	})
+}
+
+// canceled reports the error of the client's context, if any, so that long
+// multi-query operations can stop early.
+func (g *Glauth) canceled() error {
+	return g.ctx.Err()
+}
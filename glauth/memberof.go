@@ -0,0 +1,100 @@
+package glauth
+
+import (
+	"errors"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"gorm.io/gorm"
+)
+
+// EffectiveGroups returns every group the user is a member of: its primary group, its other groups
+// and, transitively, the groups including them, as GLAuth renders memberOf. Each group comes with
+// the shortest path explaining the membership; the primary group comes first, then the other groups
+// and the include groups by distance.
+func (g *Glauth) EffectiveGroups(name string) ([]*ressources.EffectiveGroup, error) {
+	var user models.User
+	err := g.db.Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &UserError{Name: name, Err: ErrUserNotFound}
+		}
+		return nil, err
+	}
+
+	graph, err := g.loadIncludeGraph(false)
+	if err != nil {
+		return nil, err
+	}
+
+	// breadth first search from the groups of the user up to the groups including them
+	paths := make(map[int][]int)
+	var queue []int
+	for _, gid := range append([]int{user.PrimaryGroup}, parseGIDs(string(user.OtherGroups))...) {
+		if _, ok := paths[gid]; gid == 0 || ok {
+			continue
+		}
+
+		paths[gid] = []int{gid}
+		queue = append(queue, gid)
+	}
+
+	for i := 0; i < len(queue); i++ {
+		gid := queue[i]
+		for _, parent := range graph.parents[gid] {
+			if _, ok := paths[parent]; ok {
+				continue
+			}
+
+			paths[parent] = append(append([]int(nil), paths[gid]...), parent)
+			queue = append(queue, parent)
+		}
+	}
+
+	if err := g.canceled(); err != nil {
+		return nil, err
+	}
+
+	var groups []*models.LDAPGroup
+	err = g.db.Table("ldapgroups").Where("gidnumber IN ?", queue).Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	groupsByGID := make(map[int]*models.LDAPGroup, len(groups))
+	for _, gr := range groups {
+		groupsByGID[gr.GIDNumber] = gr
+	}
+
+	// groups referenced but missing from ldapgroups are not rendered by GLAuth
+	var res []*ressources.EffectiveGroup
+	for _, gid := range queue {
+		gr, ok := groupsByGID[gid]
+		if !ok {
+			continue
+		}
+
+		res = append(res, &ressources.EffectiveGroup{
+			Group: *groupModelToResource(gr),
+			Path:  paths[gid],
+		})
+	}
+
+	return res, nil
+}
+
+// IsMember reports whether the user is a member of the group, directly or through include groups
+func (g *Glauth) IsMember(name string, gid int) (bool, error) {
+	groups, err := g.EffectiveGroups(name)
+	if err != nil {
+		return false, err
+	}
+
+	for _, gr := range groups {
+		if gr.GIDNumber == gid {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
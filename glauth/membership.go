@@ -0,0 +1,220 @@
+package glauth
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrAlreadyMember      = errors.New("user already member of the group")
+	ErrNotMember          = errors.New("user not member of the group")
+	ErrRemovePrimaryGroup = errors.New("primary group cannot be removed")
+)
+
+// MembershipError is returned when a change of the other groups of a user conflicts with its
+// current membership of the group, e.g. ErrAlreadyMember or ErrRemovePrimaryGroup
+type MembershipError struct {
+	Name      string // user name
+	GIDNumber int    // group GID
+	Err       error
+}
+
+func (e *MembershipError) Error() string {
+	return "user " + e.Name + " in group with GID " + strconv.Itoa(e.GIDNumber) + ": " + e.Err.Error()
+}
+
+func (e *MembershipError) Unwrap() error {
+	return e.Err
+}
+
+// AddUserToGroup adds the group to the other groups of the user
+func (g *Glauth) AddUserToGroup(name string, gid int) error {
+	return g.Transaction(func(tx *Glauth) error {
+		err := tx.lockGroups(gid)
+		if err != nil {
+			return err
+		}
+
+		user, err := tx.lockUser(name)
+		if err != nil {
+			return err
+		}
+
+		if user.PrimaryGroup == gid {
+			return &MembershipError{Name: name, GIDNumber: gid, Err: ErrPrimaryInOtherList}
+		}
+
+		others := parseGIDs(string(user.OtherGroups))
+		if containsGID(others, gid) {
+			return &MembershipError{Name: name, GIDNumber: gid, Err: ErrAlreadyMember}
+		}
+
+		return tx.setOtherGroups(user, append(others, gid))
+	})
+}
+
+// RemoveUserFromGroup removes the group from the other groups of the user. The group does not
+// need to exist, so that references to deleted groups can be cleaned up.
+func (g *Glauth) RemoveUserFromGroup(name string, gid int) error {
+	return g.Transaction(func(tx *Glauth) error {
+		user, err := tx.lockUser(name)
+		if err != nil {
+			return err
+		}
+
+		others := parseGIDs(string(user.OtherGroups))
+		if !containsGID(others, gid) {
+			if user.PrimaryGroup == gid {
+				return &MembershipError{Name: name, GIDNumber: gid, Err: ErrRemovePrimaryGroup}
+			}
+			return &MembershipError{Name: name, GIDNumber: gid, Err: ErrNotMember}
+		}
+
+		return tx.setOtherGroups(user, removeGID(others, gid))
+	})
+}
+
+// SetGroupMembers makes names the exact list of the direct members of the group, adding the group
+// to or removing it from the other groups of the users as needed, and returns the names of the
+// users added and removed. The users whose primary group it is cannot be removed, they must be
+// part of names.
+func (g *Glauth) SetGroupMembers(gid int, names []string) (added, removed []string, err error) {
+	err = g.Transaction(func(tx *Glauth) error {
+		added, removed = nil, nil
+
+		err := tx.lockGroups(gid)
+		if err != nil {
+			return err
+		}
+
+		var users []*models.User
+		err = tx.db.Table("users").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("name IN ? OR primarygroup = ? OR FIND_IN_SET(?, othergroups) > 0", names, gid, strconv.Itoa(gid)).
+			Order("uidnumber").
+			Find(&users).Error
+		if err != nil {
+			return err
+		}
+
+		want := make(map[string]bool, len(names))
+		for _, n := range names {
+			want[n] = true
+		}
+
+		found := make(map[string]bool, len(users))
+		for _, u := range users {
+			found[u.Name] = true
+		}
+
+		for _, n := range names {
+			if !found[n] {
+				return &UserError{Name: n, Err: ErrUserNotFound}
+			}
+		}
+
+		for _, u := range users {
+			others := parseGIDs(string(u.OtherGroups))
+			member := containsGID(others, gid)
+
+			switch {
+			case u.PrimaryGroup == gid:
+				if !want[u.Name] {
+					return &MembershipError{Name: u.Name, GIDNumber: gid, Err: ErrRemovePrimaryGroup}
+				}
+			case want[u.Name] && !member:
+				err = tx.setOtherGroups(u, append(others, gid))
+				added = append(added, u.Name)
+			case !want[u.Name] && member:
+				err = tx.setOtherGroups(u, removeGID(others, gid))
+				removed = append(removed, u.Name)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return added, removed, nil
+}
+
+// ListGroupMembers returns the users directly member of the group, through their primary group or
+// their other groups, ordered by UID. Members through include groups are not listed.
+func (g *Glauth) ListGroupMembers(gid int) ([]*ressources.GroupMember, error) {
+	exists, err := g.GroupExistByGID(gid)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exists {
+		return nil, &GroupError{GIDNumber: gid, Err: ErrGroupNotFound}
+	}
+
+	var users []*models.User
+	err = g.db.Table("users").Select("id", "name", "uidnumber", "primarygroup").
+		Where("primarygroup = ? OR FIND_IN_SET(?, othergroups) > 0", gid, strconv.Itoa(gid)).
+		Order("uidnumber").
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var members []*ressources.GroupMember
+	for _, u := range users {
+		members = append(members, &ressources.GroupMember{
+			Name:      u.Name,
+			UIDNumber: u.UIDNumber,
+			Primary:   u.PrimaryGroup == gid,
+		})
+	}
+
+	return members, nil
+}
+
+// lockUser returns the user, its row being locked for the rest of the transaction
+func (g *Glauth) lockUser(name string) (*models.User, error) {
+	var user models.User
+	err := g.db.Table("users").Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &UserError{Name: name, Err: ErrUserNotFound}
+		}
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// setOtherGroups stores the other groups of the user, leaving its other columns untouched
+func (g *Glauth) setOtherGroups(user *models.User, gids []int) error {
+	user.OtherGroups = []byte(ToCommaSeparatedString(gids))
+	return g.db.Table("users").Where("id = ?", user.ID).Update("othergroups", string(user.OtherGroups)).Error
+}
+
+func containsGID(gids []int, gid int) bool {
+	for _, id := range gids {
+		if id == gid {
+			return true
+		}
+	}
+	return false
+}
+
+func removeGID(gids []int, gid int) []int {
+	var res []int
+	for _, id := range gids {
+		if id != gid {
+			res = append(res, id)
+		}
+	}
+	return res
+}
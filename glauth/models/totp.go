@@ -0,0 +1,10 @@
+package models
+
+// TOTPEnrollment Struct for totpenrollments table, used by this library only: GLAuth does not render
+// it, so pending secrets are not exposed as LDAP attributes
+type TOTPEnrollment struct {
+	ID      int    // internal id number
+	UserID  int    `gorm:"column:userid"`  // UID of the enrolling user
+	Secret  string `gorm:"column:secret"`  // TOTP secret awaiting confirmation
+	Expires int64  `gorm:"column:expires"` // unix time after which the enrollment can no longer be confirmed
+}
@@ -0,0 +1,165 @@
+package glauth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultPageLimit = 100
+	MaxPageLimit     = 1000
+)
+
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// cursor identifies the last item of a page and the order of the pages. Items are sorted by UID or
+// GID then by internal id, as the former are not necessarily unique.
+type cursor struct {
+	Order  ressources.SortOrder
+	Number int
+	ID     int
+}
+
+func (c cursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d:%d", c.Order, c.Number, c.ID)))
+}
+
+// decodeCursor decodes a cursor, which must have been returned for the same order
+func decodeCursor(s string, order ressources.SortOrder) (*cursor, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c cursor
+	_, err = fmt.Sscanf(string(b), "%d:%d:%d", &c.Order, &c.Number, &c.ID)
+	if err != nil || c.encode() != s {
+		return nil, ErrInvalidCursor
+	}
+
+	if c.Order != order {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// paginate counts the rows matched by db, then restricts it to the page described by p using the
+// column holding the UID or GID as key. One more row than the limit is selected to detect the last page.
+func paginate(db *gorm.DB, column string, p *ressources.PageOptions) (*gorm.DB, int, int64, error) {
+	if p == nil {
+		p = &ressources.PageOptions{}
+	}
+
+	var total int64
+	err := db.Session(&gorm.Session{}).Count(&total).Error
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	limit := p.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+	if limit > MaxPageLimit {
+		limit = MaxPageLimit
+	}
+
+	c, err := decodeCursor(p.Cursor, p.Order)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	op, dir := ">", "ASC"
+	if p.Order == ressources.SortDescending {
+		op, dir = "<", "DESC"
+	}
+
+	if c != nil {
+		db = db.Where(fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", column, op), c.Number, c.Number, c.ID)
+	}
+
+	db = db.Order(column + " " + dir).Order("id " + dir).Limit(limit + 1)
+
+	return db, limit, total, nil
+}
+
+// GetUsersPage returns one page of all users
+func (g *Glauth) GetUsersPage(p *ressources.PageOptions) (*ressources.UserPage, error) {
+	return g.SearchUsersPage(nil, p)
+}
+
+// SearchUsersPage returns one page of the users matching q
+func (g *Glauth) SearchUsersPage(q *ressources.UserQuery, p *ressources.PageOptions) (*ressources.UserPage, error) {
+	db, limit, total, err := paginate(g.userQuery(q), "uidnumber", p)
+	if err != nil {
+		return nil, err
+	}
+
+	var users []*models.User
+	err = db.Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ressources.UserPage{Total: total}
+	if len(users) > limit {
+		users = users[:limit]
+		last := users[limit-1]
+		page.NextCursor = cursor{Order: pageOrder(p), Number: last.UIDNumber, ID: last.ID}.encode()
+	}
+
+	page.Users, err = g.usersModelToResources(users)
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// GetGroupsPage returns one page of all groups
+func (g *Glauth) GetGroupsPage(p *ressources.PageOptions) (*ressources.GroupPage, error) {
+	db, limit, total, err := paginate(g.db.Table("ldapgroups"), "gidnumber", p)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []*models.LDAPGroup
+	err = db.Find(&groups).Error
+	if err != nil {
+		return nil, err
+	}
+
+	page := &ressources.GroupPage{Total: total}
+	if len(groups) > limit {
+		groups = groups[:limit]
+		last := groups[limit-1]
+		page.NextCursor = cursor{Order: pageOrder(p), Number: last.GIDNumber, ID: last.ID}.encode()
+	}
+
+	for _, gr := range groups {
+		page.Groups = append(page.Groups, &ressources.Group{
+			ID:        gr.ID,
+			Name:      gr.Name,
+			GIDNumber: gr.GIDNumber,
+		})
+	}
+
+	return page, nil
+}
+
+func pageOrder(p *ressources.PageOptions) ressources.SortOrder {
+	if p == nil {
+		return ressources.SortAscending
+	}
+	return p.Order
+}
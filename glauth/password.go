@@ -0,0 +1,48 @@
+package glauth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrUnknownPasswordScheme = errors.New("unknown password scheme")
+
+// hashedPassword holds the values of the passsha256 and passbcrypt columns; only one is set,
+// so that GLAuth never accepts a password stored with the other scheme.
+type hashedPassword struct {
+	SHA256 string
+	BCrypt string
+}
+
+func (h *hashedPassword) columns() map[string]interface{} {
+	return map[string]interface{}{
+		"passsha256": h.SHA256,
+		"passbcrypt": h.BCrypt,
+	}
+}
+
+// hashPassword hashes password the way GLAuth expects it with the given scheme, or the
+// client-wide one when scheme is PasswordSchemeDefault
+func (g *Glauth) hashPassword(password string, scheme ressources.PasswordScheme) (*hashedPassword, error) {
+	if scheme == ressources.PasswordSchemeDefault {
+		scheme = g.context.passwordScheme()
+	}
+
+	switch scheme {
+	case ressources.PasswordSchemeSHA256:
+		sum := sha256.Sum256([]byte(password))
+		return &hashedPassword{SHA256: hex.EncodeToString(sum[:])}, nil
+	case ressources.PasswordSchemeBCrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), g.context.bcryptCost())
+		if err != nil {
+			return nil, err
+		}
+		return &hashedPassword{BCrypt: hex.EncodeToString(hash)}, nil
+	default:
+		return nil, ErrUnknownPasswordScheme
+	}
+}
@@ -0,0 +1,162 @@
+package glauth
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+)
+
+var ErrPasswordPolicy = errors.New("password does not satisfy the password policy")
+
+// PasswordViolation describes one rule of a password policy the password does not satisfy
+type PasswordViolation struct {
+	Rule    string // rule identifier, e.g. "min_length"
+	Field   string // user attribute the password conflicts with, empty for rules on the password alone
+	Message string // human readable explanation
+}
+
+// PasswordPolicyError is returned when a password is refused by the client's PasswordPolicy
+type PasswordPolicyError struct {
+	Violations []PasswordViolation
+}
+
+func (e *PasswordPolicyError) Error() string {
+	var msgs []string
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Message)
+	}
+	return ErrPasswordPolicy.Error() + ": " + strings.Join(msgs, ", ")
+}
+
+func (e *PasswordPolicyError) Unwrap() error {
+	return ErrPasswordPolicy
+}
+
+// PasswordPolicy validates a password before it is stored. The user holds the attributes the
+// password is being set for; only its basic fields are filled.
+type PasswordPolicy interface {
+	Validate(password string, user *ressources.User) []PasswordViolation
+}
+
+// PasswordRule is a custom rule of a BasicPasswordPolicy, it returns nil when the password is accepted
+type PasswordRule func(password string, user *ressources.User) *PasswordViolation
+
+// BasicPasswordPolicy is a PasswordPolicy covering the common requirements; zero values disable a rule
+type BasicPasswordPolicy struct {
+	MinLength     int  // minimum number of characters
+	MaxLength     int  // maximum number of characters
+	RequireLower  bool // at least one lower case letter
+	RequireUpper  bool // at least one upper case letter
+	RequireDigit  bool // at least one digit
+	RequireSymbol bool // at least one character that is neither a letter nor a digit
+
+	// DisallowUserAttributes rejects passwords containing the user's name, mail local part or given name
+	DisallowUserAttributes bool
+
+	Rules []PasswordRule // additional rules, run after the ones above
+}
+
+func (p *BasicPasswordPolicy) Validate(password string, user *ressources.User) []PasswordViolation {
+	var violations []PasswordViolation
+
+	length := utf8.RuneCountInString(password)
+	if p.MinLength > 0 && length < p.MinLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    "min_length",
+			Message: "must be at least " + strconv.Itoa(p.MinLength) + " characters long",
+		})
+	}
+
+	if p.MaxLength > 0 && length > p.MaxLength {
+		violations = append(violations, PasswordViolation{
+			Rule:    "max_length",
+			Message: "must be at most " + strconv.Itoa(p.MaxLength) + " characters long",
+		})
+	}
+
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			symbol = true
+		}
+	}
+
+	if p.RequireLower && !lower {
+		violations = append(violations, PasswordViolation{Rule: "require_lower", Message: "must contain a lower case letter"})
+	}
+	if p.RequireUpper && !upper {
+		violations = append(violations, PasswordViolation{Rule: "require_upper", Message: "must contain an upper case letter"})
+	}
+	if p.RequireDigit && !digit {
+		violations = append(violations, PasswordViolation{Rule: "require_digit", Message: "must contain a digit"})
+	}
+	if p.RequireSymbol && !symbol {
+		violations = append(violations, PasswordViolation{Rule: "require_symbol", Message: "must contain a symbol"})
+	}
+
+	if p.DisallowUserAttributes && user != nil {
+		mail, _, _ := strings.Cut(user.Mail, "@")
+		attrs := []struct{ field, value string }{
+			{"name", user.Name},
+			{"mail", mail},
+			{"givenname", user.GivenName},
+		}
+
+		lp := strings.ToLower(password)
+		for _, a := range attrs {
+			// very short values would reject too many passwords
+			if utf8.RuneCountInString(a.value) < 3 {
+				continue
+			}
+
+			if strings.Contains(lp, strings.ToLower(a.value)) {
+				violations = append(violations, PasswordViolation{
+					Rule:    "user_attribute",
+					Field:   a.field,
+					Message: "must not contain the " + a.field,
+				})
+			}
+		}
+	}
+
+	for _, rule := range p.Rules {
+		if v := rule(password, user); v != nil {
+			violations = append(violations, *v)
+		}
+	}
+
+	return violations
+}
+
+// validatePassword enforces the client's PasswordPolicy, if any, for a password set on u
+func (g *Glauth) validatePassword(password string, u *models.User) error {
+	if g.context.PasswordPolicy == nil {
+		return nil
+	}
+
+	violations := g.context.PasswordPolicy.Validate(password, &ressources.User{
+		ID:        u.ID,
+		Name:      u.Name,
+		UIDNumber: u.UIDNumber,
+		GivenName: u.GivenName,
+		SN:        u.SN,
+		Mail:      u.Mail,
+	})
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+
+	return nil
+}
@@ -0,0 +1,154 @@
+package glauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"gorm.io/gorm"
+)
+
+// RecoveryCodesAttr is the custom attribute holding the SHA256 hashes of the user's unused recovery codes.
+// GLAuth renders custom attributes as LDAP attributes, so only the hashes are ever stored. The
+// generic custom attribute accessors refuse to write it.
+const RecoveryCodesAttr = "otpRecoveryCodes"
+
+const (
+	recoveryCodeBytes = 10 // 80 bits, 16 base32 characters
+	recoveryCodeGroup = 4  // characters between dashes in a formatted code
+)
+
+var (
+	ErrRecoveryCodesExist   = errors.New("recovery codes already generated")
+	ErrInvalidRecoveryCode  = errors.New("invalid recovery code")
+	ErrInvalidRecoveryCount = errors.New("recovery code count must be positive")
+)
+
+var recoveryEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateRecoveryCodes generates n single-use recovery codes for the user, to be used when the
+// authenticator holding the OTP secret is lost. The codes are returned once and only their hashes
+// are stored; it fails if the user still has unused codes, see RegenerateRecoveryCodes.
+func (g *Glauth) GenerateRecoveryCodes(name string, n int) ([]string, error) {
+	return g.generateRecoveryCodes(name, n, false)
+}
+
+// RegenerateRecoveryCodes replaces the user's recovery codes with n new ones
+func (g *Glauth) RegenerateRecoveryCodes(name string, n int) ([]string, error) {
+	return g.generateRecoveryCodes(name, n, true)
+}
+
+func (g *Glauth) generateRecoveryCodes(name string, n int, replace bool) ([]string, error) {
+	if n <= 0 {
+		return nil, ErrInvalidRecoveryCount
+	}
+
+	codes := make([]string, n)
+	hashes := make([]interface{}, n)
+	for i := range codes {
+		b := make([]byte, recoveryCodeBytes)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		codes[i] = formatRecoveryCode(strings.ToLower(recoveryEncoding.EncodeToString(b)))
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	err := g.updateCustAttr(name, func(attrs map[string]interface{}) error {
+		if !replace && len(recoveryHashes(attrs)) > 0 {
+			return &UserError{Name: name, Err: ErrRecoveryCodesExist}
+		}
+
+		attrs[RecoveryCodesAttr] = hashes
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// ConsumeRecoveryCode checks code against the user's unused recovery codes and, if it matches one,
+// removes it so that it cannot be used again
+func (g *Glauth) ConsumeRecoveryCode(name, code string) error {
+	hash := hashRecoveryCode(code)
+
+	return g.updateCustAttr(name, func(attrs map[string]interface{}) error {
+		hashes := recoveryHashes(attrs)
+
+		for i, h := range hashes {
+			if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+				remaining := make([]interface{}, 0, len(hashes)-1)
+				for j, r := range hashes {
+					if j != i {
+						remaining = append(remaining, r)
+					}
+				}
+
+				attrs[RecoveryCodesAttr] = remaining
+				return nil
+			}
+		}
+
+		return &UserError{Name: name, Err: ErrInvalidRecoveryCode}
+	})
+}
+
+// RemainingRecoveryCodes returns the number of unused recovery codes of the user
+func (g *Glauth) RemainingRecoveryCodes(name string) (int, error) {
+	var user models.User
+	err := g.db.Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, &UserError{Name: name, Err: ErrUserNotFound}
+		}
+		return 0, err
+	}
+
+	attrs, err := decodeCustAttr(user.CustAttr)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(recoveryHashes(attrs)), nil
+}
+
+// recoveryHashes returns the recovery code hashes stored in attrs
+func recoveryHashes(attrs map[string]interface{}) []string {
+	list, _ := attrs[RecoveryCodesAttr].([]interface{})
+
+	var hashes []string
+	for _, h := range list {
+		if s, ok := h.(string); ok {
+			hashes = append(hashes, s)
+		}
+	}
+
+	return hashes
+}
+
+// hashRecoveryCode hashes a code ignoring case, dashes and spaces, so it can be typed loosely
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func formatRecoveryCode(code string) string {
+	var groups []string
+	for len(code) > recoveryCodeGroup {
+		groups = append(groups, code[:recoveryCodeGroup])
+		code = code[recoveryCodeGroup:]
+	}
+
+	return strings.Join(append(groups, code), "-")
+}
@@ -15,3 +15,31 @@ type UpdateGroup struct {
 	Name      *string
 	GIDNumber *int
 }
+
+// EffectiveGroup is a group a user is a member of, directly or through include groups
+type EffectiveGroup struct {
+	Group
+	Path []int // GIDs from the user's primary or other group to this group, each one included in the next
+}
+
+// GroupMember is a user directly member of a group
+type GroupMember struct {
+	Name      string
+	UIDNumber int
+	Primary   bool // whether the group is the primary group of the user, otherwise it is one of its other groups
+}
+
+// IncludeGroup is a relationship between a parent group and a group it includes
+type IncludeGroup struct {
+	ParentGID  int
+	IncludeGID int
+}
+
+// GroupUpdatePreview lists the rows an update of a group changes, as they are before the update
+type GroupUpdatePreview struct {
+	Name          string         // name of the group
+	GIDNumber     int            // GID of the group
+	PrimaryUsers  []string       // users whose primary group is renumbered
+	OtherUsers    []string       // users whose other groups are renumbered
+	IncludeGroups []IncludeGroup // include group relationships the group is renumbered in
+}
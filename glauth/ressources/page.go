@@ -0,0 +1,26 @@
+package ressources
+
+type SortOrder int
+
+const (
+	SortAscending  SortOrder = iota // lowest UID or GID first
+	SortDescending                  // highest UID or GID first
+)
+
+type PageOptions struct {
+	Limit  int       // maximum number of items in the page, a default applies when 0
+	Cursor string    // NextCursor of the previous page requested with the same Order, empty for the first page
+	Order  SortOrder // order of the items by UID or GID
+}
+
+type UserPage struct {
+	Users      []*User
+	Total      int64  // number of users matching, over all pages
+	NextCursor string // cursor of the next page, empty on the last page
+}
+
+type GroupPage struct {
+	Groups     []*Group
+	Total      int64  // number of groups, over all pages
+	NextCursor string // cursor of the next page, empty on the last page
+}
@@ -0,0 +1,22 @@
+package ressources
+
+type PasswordScheme string
+
+const (
+	PasswordSchemeDefault PasswordScheme = ""       // the client-wide scheme
+	PasswordSchemeSHA256  PasswordScheme = "sha256" // unsalted SHA256, stored hex-encoded in passsha256
+	PasswordSchemeBCrypt  PasswordScheme = "bcrypt" // bcrypt, stored hex-encoded in passbcrypt
+)
+
+func (s PasswordScheme) String() string {
+	switch s {
+	case PasswordSchemeDefault:
+		return "default"
+	case PasswordSchemeSHA256:
+		return "sha256"
+	case PasswordSchemeBCrypt:
+		return "bcrypt"
+	default:
+		return "unknown"
+	}
+}
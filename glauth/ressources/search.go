@@ -0,0 +1,35 @@
+package ressources
+
+type MatchMode int
+
+const (
+	MatchExact    MatchMode = iota // the attribute equals the value
+	MatchPrefix                    // the attribute starts with the value
+	MatchContains                  // the attribute contains the value
+)
+
+type StringFilter struct {
+	Value string
+	Match MatchMode
+}
+
+type CustAttrFilter struct {
+	Key   string      // top-level custom attribute name
+	Value interface{} // value the attribute must equal, nil only requires the attribute to be present
+}
+
+// UserQuery selects users matching every filter that is set
+type UserQuery struct {
+	Name      *StringFilter
+	Mail      *StringFilter
+	GivenName *StringFilter
+	SN        *StringFilter
+	Disabled  *bool
+	MemberOf  *int // GID of a group the user has as primary group or in its other groups
+
+	HasOTP     *bool
+	HasYubikey *bool
+	HasSSHKeys *bool
+
+	CustAttr []CustAttrFilter
+}
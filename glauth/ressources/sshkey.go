@@ -0,0 +1,9 @@
+package ressources
+
+type SSHKey struct {
+	Type        string // key type, e.g. “ssh-ed25519”
+	Fingerprint string // SHA256 fingerprint, e.g. “SHA256:…”
+	Comment     string // comment following the key, usually identifying its owner
+	Bits        int    // key size in bits
+	Key         string // the key in authorized_keys format
+}
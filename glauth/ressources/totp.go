@@ -0,0 +1,7 @@
+package ressources
+
+type TOTPEnrollment struct {
+	Secret string // base32 encoded secret, to be entered manually in an authenticator
+	URI    string // otpauth:// provisioning URI
+	QRCode []byte // PNG encoded QR code of URI
+}
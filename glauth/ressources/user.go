@@ -22,40 +22,42 @@ type User struct {
 }
 
 type CreateUser struct {
-	ID            int
-	Name          string
-	UIDNumber     int
-	PrimaryGroup  int
-	OtherGroups   []int
-	Capabilities  []*Capability
-	GivenName     string
-	SN            string
-	Mail          string
-	LoginShell    string
-	HomeDirectory string
-	Disabled      bool
-	Password      string
-	OTPSecret     string
-	Yubikey       string
-	SSHKeys       string
-	CustAttr      string
+	ID             int
+	Name           string
+	UIDNumber      int
+	PrimaryGroup   int
+	OtherGroups    []int
+	Capabilities   []*Capability
+	GivenName      string
+	SN             string
+	Mail           string
+	LoginShell     string
+	HomeDirectory  string
+	Disabled       bool
+	Password       string
+	PasswordScheme PasswordScheme // scheme used to store Password, the client-wide one when unset
+	OTPSecret      string
+	Yubikey        string
+	SSHKeys        string
+	CustAttr       string
 }
 
 type UpdateUser struct {
-	ID            int
-	UIDNumber     *int
-	PrimaryGroup  *int
-	OtherGroups   *[]int
-	Capabilities  *[]*Capability
-	GivenName     *string
-	SN            *string
-	Mail          *string
-	LoginShell    *string
-	HomeDirectory *string
-	Disabled      *bool
-	Password      *string
-	OTPSecret     *string
-	Yubikey       *string
-	SSHKeys       *string
-	CustAttr      *string
+	ID             int
+	UIDNumber      *int
+	PrimaryGroup   *int
+	OtherGroups    *[]int
+	Capabilities   *[]*Capability
+	GivenName      *string
+	SN             *string
+	Mail           *string
+	LoginShell     *string
+	HomeDirectory  *string
+	Disabled       *bool
+	Password       *string
+	PasswordScheme PasswordScheme // scheme used to store Password, the client-wide one when unset
+	OTPSecret      *string
+	Yubikey        *string
+	SSHKeys        *string
+	CustAttr       *string
 }
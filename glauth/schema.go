@@ -0,0 +1,194 @@
+package glauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"gorm.io/gorm"
+)
+
+// CustAttrViolation describes one way custom attributes do not match a CustAttrSchema
+type CustAttrViolation struct {
+	Path    string // JSON pointer to the offending value, e.g. “/employeeNumber”
+	Message string // human readable explanation
+}
+
+// CustAttrSchemaError is returned when custom attributes do not match the client's CustAttrSchema
+type CustAttrSchemaError struct {
+	Violations []CustAttrViolation
+}
+
+func (e *CustAttrSchemaError) Error() string {
+	var msgs []string
+	for _, v := range e.Violations {
+		msgs = append(msgs, v.Path+": "+v.Message)
+	}
+	return ErrInvalidCustAttr.Error() + ": " + strings.Join(msgs, ", ")
+}
+
+func (e *CustAttrSchemaError) Unwrap() error {
+	return ErrInvalidCustAttr
+}
+
+// CustAttrSchema validates the decoded custom attributes of a user. Attributes reserved by the
+// library, such as RecoveryCodesAttr, are removed before validation.
+type CustAttrSchema interface {
+	Validate(attrs map[string]interface{}) []CustAttrViolation
+}
+
+type jsonSchema struct {
+	schema *jsonschema.Schema
+}
+
+// NewJSONSchema compiles a JSON Schema document into a CustAttrSchema
+func NewJSONSchema(schema []byte) (CustAttrSchema, error) {
+	const url = "custattr.schema.json"
+
+	c := jsonschema.NewCompiler()
+	err := c.AddResource(url, bytes.NewReader(schema))
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := c.Compile(url)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jsonSchema{schema: s}, nil
+}
+
+func (s *jsonSchema) Validate(attrs map[string]interface{}) []CustAttrViolation {
+	err := s.schema.Validate(attrs)
+	if err == nil {
+		return nil
+	}
+
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []CustAttrViolation{{Path: "/", Message: err.Error()}}
+	}
+
+	var violations []CustAttrViolation
+	var leaves func(ve *jsonschema.ValidationError)
+	leaves = func(ve *jsonschema.ValidationError) {
+		if len(ve.Causes) == 0 {
+			path := ve.InstanceLocation
+			if path == "" {
+				path = "/"
+			}
+			violations = append(violations, CustAttrViolation{Path: path, Message: ve.Message})
+			return
+		}
+
+		for _, c := range ve.Causes {
+			leaves(c)
+		}
+	}
+	leaves(ve)
+
+	return violations
+}
+
+type structSchema[T any] struct {
+	disallowUnknownFields bool
+}
+
+// NewStructSchema returns a CustAttrSchema accepting the attributes that decode into a T, typically
+// a struct with json tags. With disallowUnknownFields, attributes without a matching field are refused.
+func NewStructSchema[T any](disallowUnknownFields bool) CustAttrSchema {
+	return &structSchema[T]{disallowUnknownFields: disallowUnknownFields}
+}
+
+func (s *structSchema[T]) Validate(attrs map[string]interface{}) []CustAttrViolation {
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return []CustAttrViolation{{Path: "/", Message: err.Error()}}
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	if s.disallowUnknownFields {
+		d.DisallowUnknownFields()
+	}
+
+	err = d.Decode(new(T))
+	if err == nil {
+		return nil
+	}
+
+	var te *json.UnmarshalTypeError
+	if errors.As(err, &te) {
+		return []CustAttrViolation{{
+			Path:    "/" + strings.ReplaceAll(te.Field, ".", "/"),
+			Message: "expected " + te.Type.String() + ", got " + te.Value,
+		}}
+	}
+
+	return []CustAttrViolation{{Path: "/", Message: err.Error()}}
+}
+
+// validateCustAttr checks attrs against the client's CustAttrSchema, if any
+func (g *Glauth) validateCustAttr(attrs map[string]interface{}) error {
+	schema := g.context.CustAttrSchema
+	if schema == nil {
+		return nil
+	}
+
+	if _, ok := attrs[RecoveryCodesAttr]; ok {
+		user := make(map[string]interface{}, len(attrs))
+		for k, v := range attrs {
+			user[k] = v
+		}
+		delete(user, RecoveryCodesAttr)
+		attrs = user
+	}
+
+	violations := schema.Validate(attrs)
+	if len(violations) > 0 {
+		return &CustAttrSchemaError{Violations: violations}
+	}
+
+	return nil
+}
+
+// CustAttrReport describes a user whose stored custom attributes are invalid
+type CustAttrReport struct {
+	Name      string
+	UIDNumber int
+	Err       error // a *CustAttrSchemaError, or the JSON decoding error wrapping ErrInvalidCustAttr
+}
+
+// ValidateAllCustAttrs checks the stored custom attributes of every user against the client's
+// CustAttrSchema and reports the users whose attributes are invalid
+func (g *Glauth) ValidateAllCustAttrs() ([]*CustAttrReport, error) {
+	var reports []*CustAttrReport
+	var users []*models.User
+	err := g.db.Table("users").Select("id", "name", "uidnumber", "custattr").
+		FindInBatches(&users, 500, func(tx *gorm.DB, batch int) error {
+			if err := g.canceled(); err != nil {
+				return err
+			}
+
+			for _, u := range users {
+				attrs, err := decodeCustAttr(u.CustAttr)
+				if err == nil {
+					err = g.validateCustAttr(attrs)
+				}
+
+				if err != nil {
+					reports = append(reports, &CustAttrReport{Name: u.Name, UIDNumber: u.UIDNumber, Err: err})
+				}
+			}
+
+			return nil
+		}).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return reports, nil
+}
@@ -0,0 +1,98 @@
+package glauth
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"gorm.io/gorm"
+)
+
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUsers returns the users matching every filter of q, ordered by UID
+func (g *Glauth) SearchUsers(q *ressources.UserQuery) ([]*ressources.User, error) {
+	var users []*models.User
+	err := g.userQuery(q).Order("uidnumber").Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return g.usersModelToResources(users)
+}
+
+// userQuery compiles q to the conditions of a query on the users table
+func (g *Glauth) userQuery(q *ressources.UserQuery) *gorm.DB {
+	db := g.db.Model(&models.User{})
+	if q == nil {
+		return db
+	}
+
+	db = whereString(db, "name", q.Name)
+	db = whereString(db, "mail", q.Mail)
+	db = whereString(db, "givenname", q.GivenName)
+	db = whereString(db, "sn", q.SN)
+
+	if q.Disabled != nil {
+		db = db.Where("disabled = ?", *q.Disabled)
+	}
+
+	if q.MemberOf != nil {
+		db = db.Where("(primarygroup = ? OR FIND_IN_SET(?, othergroups) > 0)", *q.MemberOf, strconv.Itoa(*q.MemberOf))
+	}
+
+	db = wherePresent(db, "otpsecret", q.HasOTP)
+	db = wherePresent(db, "yubikey", q.HasYubikey)
+	db = wherePresent(db, "sshkeys", q.HasSSHKeys)
+
+	for _, f := range q.CustAttr {
+		// a JSON string is a valid path member, with the escapes MySQL expects. Rows whose custattr
+		// is not valid JSON, such as empty legacy ones, never match instead of failing the query.
+		key, _ := json.Marshal(f.Key)
+
+		path := "$." + string(key)
+		if f.Value == nil {
+			db = db.Where("JSON_CONTAINS_PATH(IF(JSON_VALID(custattr), custattr, NULL), 'one', ?) = 1", path)
+			continue
+		}
+
+		// compared as JSON, so that types and nested values have to match
+		value, err := json.Marshal(f.Value)
+		if err != nil {
+			db.AddError(invalidCustAttr(err))
+			return db
+		}
+
+		db = db.Where("JSON_EXTRACT(IF(JSON_VALID(custattr), custattr, NULL), ?) = CAST(? AS JSON)", path, string(value))
+	}
+
+	return db
+}
+
+func whereString(db *gorm.DB, column string, f *ressources.StringFilter) *gorm.DB {
+	if f == nil {
+		return db
+	}
+
+	switch f.Match {
+	case ressources.MatchPrefix:
+		return db.Where(column+" LIKE ?", likeEscaper.Replace(f.Value)+"%")
+	case ressources.MatchContains:
+		return db.Where(column+" LIKE ?", "%"+likeEscaper.Replace(f.Value)+"%")
+	default:
+		return db.Where(column+" = ?", f.Value)
+	}
+}
+
+func wherePresent(db *gorm.DB, column string, present *bool) *gorm.DB {
+	if present == nil {
+		return db
+	}
+
+	if *present {
+		return db.Where("COALESCE(" + column + ", '') <> ''")
+	}
+	return db.Where("COALESCE(" + column + ", '') = ''")
+}
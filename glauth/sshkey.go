@@ -0,0 +1,286 @@
+package glauth
+
+import (
+	"crypto/dsa"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"errors"
+	"strings"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+var (
+	ErrInvalidSSHKey     = errors.New("invalid ssh public key")
+	ErrWeakSSHKey        = errors.New("ssh public key refused by policy")
+	ErrDuplicateSSHKey   = errors.New("ssh public key already registered")
+	ErrSSHKeyNotFound    = errors.New("ssh public key not found")
+	ErrSSHKeyLockTimeout = errors.New("timed out waiting for the ssh keys lock")
+)
+
+// SSHKeyPolicy decides which SSH public keys users may register
+type SSHKeyPolicy struct {
+	DisallowedTypes []string // key types refused, e.g. “ssh-dss”
+	MinRSABits      int      // minimum size of RSA keys
+}
+
+var DefaultSSHKeyPolicy = SSHKeyPolicy{
+	DisallowedTypes: []string{ssh.KeyAlgoDSA},
+	MinRSABits:      2048,
+}
+
+// SSHKeyError describes the key an error relates to
+type SSHKeyError struct {
+	Key string // the key as given, or its fingerprint
+	Err error
+}
+
+func (e *SSHKeyError) Error() string {
+	return e.Err.Error() + ": " + e.Key
+}
+
+func (e *SSHKeyError) Unwrap() error {
+	return e.Err
+}
+
+func (p *SSHKeyPolicy) check(k *ressources.SSHKey) error {
+	for _, t := range p.DisallowedTypes {
+		if k.Type == t {
+			return &SSHKeyError{Key: k.Fingerprint, Err: ErrWeakSSHKey}
+		}
+	}
+
+	if k.Type == ssh.KeyAlgoRSA && k.Bits < p.MinRSABits {
+		return &SSHKeyError{Key: k.Fingerprint, Err: ErrWeakSSHKey}
+	}
+
+	return nil
+}
+
+// ParseSSHKey parses a single public key in authorized_keys format. Keys with options, such as
+// command= or from=, are refused: the stored key would otherwise lose its restrictions.
+func ParseSSHKey(s string) (*ressources.SSHKey, error) {
+	pub, comment, options, rest, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, &SSHKeyError{Key: s, Err: ErrInvalidSSHKey}
+	}
+
+	if len(options) > 0 || strings.TrimSpace(string(rest)) != "" {
+		return nil, &SSHKeyError{Key: s, Err: ErrInvalidSSHKey}
+	}
+
+	// keys are stored comma separated, a comma in the comment would split the key
+	if strings.Contains(comment, ",") {
+		return nil, &SSHKeyError{Key: s, Err: ErrInvalidSSHKey}
+	}
+
+	key := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub)))
+	if comment != "" {
+		key += " " + comment
+	}
+
+	return &ressources.SSHKey{
+		Type:        pub.Type(),
+		Fingerprint: ssh.FingerprintSHA256(pub),
+		Comment:     comment,
+		Bits:        sshKeyBits(pub),
+		Key:         key,
+	}, nil
+}
+
+func sshKeyBits(pub ssh.PublicKey) int {
+	cpk, ok := pub.(ssh.CryptoPublicKey)
+	if !ok {
+		return 0
+	}
+
+	switch k := cpk.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		return k.N.BitLen()
+	case *ecdsa.PublicKey:
+		return k.Curve.Params().BitSize
+	case *dsa.PublicKey:
+		return k.P.BitLen()
+	case ed25519.PublicKey:
+		return 256
+	default:
+		return 0
+	}
+}
+
+// parseSSHKeys parses the comma separated keys of the sshkeys column
+func parseSSHKeys(s string) ([]*ressources.SSHKey, error) {
+	var keys []*ressources.SSHKey
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k == "" {
+			continue
+		}
+
+		key, err := ParseSSHKey(k)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func joinSSHKeys(keys []*ressources.SSHKey) string {
+	var res []string
+	for _, k := range keys {
+		res = append(res, k.Key)
+	}
+	return strings.Join(res, ",")
+}
+
+// lockSSHKeys serializes the registration of SSH keys across clients, see lockAllocation. It is held
+// until the user row is written, so that validateSSHKeys waits for concurrent registrations.
+func (g *Glauth) lockSSHKeys() (func(), error) {
+	release, acquired, err := g.getLock("sshkeys")
+	if err != nil {
+		return nil, err
+	}
+
+	if !acquired {
+		return nil, ErrSSHKeyLockTimeout
+	}
+
+	return release, nil
+}
+
+// validateSSHKeys parses the keys given for the user, checks them against the client's policy and
+// makes sure none is registered twice or to another user. It returns the normalized column value.
+// The caller holds lockSSHKeys.
+func (g *Glauth) validateSSHKeys(name, s string) (string, error) {
+	keys, err := parseSSHKeys(s)
+	if err != nil {
+		return "", &UserError{Name: name, Err: err}
+	}
+
+	policy := g.context.sshKeyPolicy()
+	seen := make(map[string]bool)
+	for _, k := range keys {
+		err = policy.check(k)
+		if err != nil {
+			return "", &UserError{Name: name, Err: err}
+		}
+
+		if seen[k.Fingerprint] {
+			return "", &UserError{Name: name, Err: &SSHKeyError{Key: k.Fingerprint, Err: ErrDuplicateSSHKey}}
+		}
+		seen[k.Fingerprint] = true
+
+		// the base64 blob identifies the key whatever its comment
+		blob := strings.Fields(k.Key)[1]
+
+		// a locking read, to wait for the uncommitted row of the previous holder of the lock
+		var names []string
+		err = g.db.Table("users").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("sshkeys LIKE ? AND name <> ?", "%"+blob+"%", name).Pluck("name", &names).Error
+		if err != nil {
+			return "", err
+		}
+
+		if len(names) > 0 {
+			return "", &UserError{Name: name, Err: &SSHKeyError{Key: k.Fingerprint, Err: ErrDuplicateSSHKey}}
+		}
+	}
+
+	return joinSSHKeys(keys), nil
+}
+
+// ListSSHKeys returns the parsed SSH public keys of the user
+func (g *Glauth) ListSSHKeys(name string) ([]*ressources.SSHKey, error) {
+	var user models.User
+	err := g.db.Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &UserError{Name: name, Err: ErrUserNotFound}
+		}
+		return nil, err
+	}
+
+	keys, err := parseSSHKeys(user.SSHKeys)
+	if err != nil {
+		return nil, &UserError{Name: name, Err: err}
+	}
+
+	return keys, nil
+}
+
+// AddSSHKey adds a public key in authorized_keys format to the user's keys
+func (g *Glauth) AddSSHKey(name, key string) (*ressources.SSHKey, error) {
+	k, err := ParseSSHKey(key)
+	if err != nil {
+		return nil, &UserError{Name: name, Err: err}
+	}
+
+	err = g.updateSSHKeys(name, func(keys []*ressources.SSHKey) ([]*ressources.SSHKey, error) {
+		return append(keys, k), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// RemoveSSHKey removes the key with the given SHA256 fingerprint from the user's keys
+func (g *Glauth) RemoveSSHKey(name, fingerprint string) error {
+	return g.updateSSHKeys(name, func(keys []*ressources.SSHKey) ([]*ressources.SSHKey, error) {
+		for i, k := range keys {
+			if k.Fingerprint == fingerprint {
+				return append(keys[:i:i], keys[i+1:]...), nil
+			}
+		}
+
+		return nil, &UserError{Name: name, Err: &SSHKeyError{Key: fingerprint, Err: ErrSSHKeyNotFound}}
+	})
+}
+
+// updateSSHKeys applies fn to the user's keys and stores the validated result, the user row being
+// locked in between
+func (g *Glauth) updateSSHKeys(name string, fn func(keys []*ressources.SSHKey) ([]*ressources.SSHKey, error)) error {
+	return g.Transaction(func(tx *Glauth) error {
+		// taken before the user row is locked, as the other holders of the lock do
+		release, err := tx.lockSSHKeys()
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		var user models.User
+		err = tx.db.Clauses(clause.Locking{Strength: "UPDATE"}).Where("name = ?", name).First(&user).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &UserError{Name: name, Err: ErrUserNotFound}
+			}
+			return err
+		}
+
+		keys, err := parseSSHKeys(user.SSHKeys)
+		if err != nil {
+			return &UserError{Name: name, Err: err}
+		}
+
+		keys, err = fn(keys)
+		if err != nil {
+			return err
+		}
+
+		sshKeys, err := tx.validateSSHKeys(name, joinSSHKeys(keys))
+		if err != nil {
+			return err
+		}
+
+		return tx.db.Table("users").Where("id = ?", user.ID).Update("sshkeys", sshKeys).Error
+	})
+}
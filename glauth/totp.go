@@ -0,0 +1,172 @@
+package glauth
+
+import (
+	"bytes"
+	"errors"
+	"image/png"
+	"time"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"github.com/pquerna/otp/totp"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	totpEnrollmentTTL = 10 * time.Minute // time given to confirm an enrollment
+	totpQRCodeSize    = 256              // width and height of the QR code, in pixels
+)
+
+var ErrNoTOTPEnrollment = errors.New("no pending totp enrollment")
+
+// EnrollTOTP generates a TOTP secret for the user, compatible with GLAuth's OTP checks. The secret is
+// only stored as the OTP secret once ConfirmTOTP validated a first code generated from it; until
+// then it is kept in the totpenrollments table, which GLAuth does not render as LDAP attributes.
+func (g *Glauth) EnrollTOTP(name, issuer string) (*ressources.TOTPEnrollment, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      issuer,
+		AccountName: name,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := key.Image(totpQRCodeSize, totpQRCodeSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var qr bytes.Buffer
+	err = png.Encode(&qr, img)
+	if err != nil {
+		return nil, err
+	}
+
+	err = g.purgeTOTPEnrollments()
+	if err != nil {
+		return nil, err
+	}
+
+	err = g.Transaction(func(tx *Glauth) error {
+		uid, err := tx.userUID(name)
+		if err != nil {
+			return err
+		}
+
+		// a new enrollment replaces the pending one
+		err = tx.db.Table("totpenrollments").Where("userid = ?", uid).Delete(&models.TOTPEnrollment{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.db.Table("totpenrollments").Create(&models.TOTPEnrollment{
+			UserID:  uid,
+			Secret:  key.Secret(),
+			Expires: time.Now().Add(totpEnrollmentTTL).Unix(),
+		}).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &ressources.TOTPEnrollment{
+		Secret: key.Secret(),
+		URI:    key.URL(),
+		QRCode: qr.Bytes(),
+	}, nil
+}
+
+// ConfirmTOTP validates code against the secret generated by EnrollTOTP and stores the secret
+// as the user's OTP secret
+func (g *Glauth) ConfirmTOTP(name, code string) error {
+	err := g.purgeTOTPEnrollments()
+	if err != nil {
+		return err
+	}
+
+	return g.Transaction(func(tx *Glauth) error {
+		uid, err := tx.userUID(name)
+		if err != nil {
+			return err
+		}
+
+		var enrollment models.TOTPEnrollment
+		err = tx.db.Table("totpenrollments").Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("userid = ? AND expires >= ?", uid, time.Now().Unix()).First(&enrollment).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return &UserError{Name: name, Err: ErrNoTOTPEnrollment}
+			}
+			return err
+		}
+
+		if !totp.Validate(code, enrollment.Secret) {
+			return &UserError{Name: name, Err: ErrOTPInvalid}
+		}
+
+		err = tx.db.Table("totpenrollments").Where("id = ?", enrollment.ID).Delete(&models.TOTPEnrollment{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.setOTPSecret(name, enrollment.Secret)
+	})
+}
+
+// purgeTOTPEnrollments deletes the enrollments of every user which can no longer be confirmed
+func (g *Glauth) purgeTOTPEnrollments() error {
+	return g.db.Table("totpenrollments").Where("expires < ?", time.Now().Unix()).Delete(&models.TOTPEnrollment{}).Error
+}
+
+// userUID returns the UID of the user
+func (g *Glauth) userUID(name string) (int, error) {
+	var user models.User
+	err := g.db.Table("users").Select("uidnumber").Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return 0, &UserError{Name: name, Err: ErrUserNotFound}
+		}
+		return 0, err
+	}
+
+	return user.UIDNumber, nil
+}
+
+// DisableTOTP removes the user's OTP secret, recovery codes and any pending enrollment
+func (g *Glauth) DisableTOTP(name string) error {
+	return g.Transaction(func(tx *Glauth) error {
+		err := tx.setOTPSecret(name, "")
+		if err != nil {
+			return err
+		}
+
+		uid, err := tx.userUID(name)
+		if err != nil {
+			return err
+		}
+
+		err = tx.db.Table("totpenrollments").Where("userid = ?", uid).Delete(&models.TOTPEnrollment{}).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.updateCustAttr(name, func(attrs map[string]interface{}) error {
+			delete(attrs, RecoveryCodesAttr)
+			return nil
+		})
+	})
+}
+
+func (g *Glauth) setOTPSecret(name, secret string) error {
+	exists, err := g.UserExistByName(name)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return &UserError{Name: name, Err: ErrUserNotFound}
+	}
+
+	return g.db.Table("users").Where("name = ?", name).Update("otpsecret", secret).Error
+}
@@ -1,15 +1,12 @@
 package glauth
 
 import (
-	"crypto/sha256"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/mateo08c/go-glauth-mysql/glauth/models"
 	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
 	"gorm.io/gorm"
-	"strconv"
-	"strings"
+	"gorm.io/gorm/clause"
 )
 
 func (g *Glauth) UserExistByName(name string) (bool, error) {
@@ -25,9 +22,11 @@ func (g *Glauth) UserExistByName(name string) (bool, error) {
 	return true, nil
 }
 
+// UserExistByUID reports whether a user has the given UID. The read is a locking one, so inside a
+// transaction it also sees users being created by concurrent transactions.
 func (g *Glauth) UserExistByUID(uid int) (bool, error) {
 	var user models.User
-	err := g.db.Where("uidnumber = ?", uid).First(&user).Error
+	err := g.db.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uidnumber = ?", uid).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
 			return false, nil
@@ -54,102 +53,11 @@ func (g *Glauth) CreateCapability(c *ressources.Capability) error {
 	return nil
 }
 
+// FindNextUserID returns the next free UID according to the client's UserIDs policy. The read locks
+// the rows it goes through, so inside a transaction it waits for concurrent uncommitted users
+// instead of returning the same UID.
 func (g *Glauth) FindNextUserID() (int, error) {
-	var user models.User
-	err := g.db.Order("uidnumber desc").First(&user).Error
-	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return 20000, nil
-		}
-		return 0, err
-	}
-
-	return user.UIDNumber + 1, nil
-}
-
-func (g *Glauth) userModelToResource(u *models.User) (*ressources.User, error) {
-	// Création de la ressource User avec les champs de base
-	r := &ressources.User{
-		ID:            u.ID,
-		Name:          u.Name,
-		UIDNumber:     u.UIDNumber,
-		GivenName:     u.GivenName,
-		SN:            u.SN,
-		Mail:          u.Mail,
-		LoginShell:    u.LoginShell,
-		HomeDirectory: u.HomeDirectory,
-		Disabled:      u.Disabled,
-		PassSHA256:    u.PassSHA256,
-		PassBCrypt:    u.PassBCrypt,
-		OTPSecret:     u.OTPSecret,
-		Yubikey:       u.Yubikey,
-		SSHKeys:       u.SSHKeys,
-		CustAttr:      u.CustAttr,
-	}
-
-	// Ajout du primary group s'il est défini dans le modèle User
-	if u.PrimaryGroup != 0 {
-		pg, err := g.GetGroupByGID(u.PrimaryGroup)
-		if err == nil {
-			if pg != nil {
-				r.PrimaryGroup = &ressources.Group{
-					ID:        pg.ID,
-					Name:      pg.Name,
-					GIDNumber: pg.GIDNumber,
-				}
-			}
-		}
-	}
-
-	// Ajout des other groups s'ils sont définis dans le modèle User
-	if u.OtherGroups != nil && len(u.OtherGroups) > 0 {
-		ogIDs := strings.Split(strings.Trim(string(u.OtherGroups), ","), ",")
-		for _, gID := range ogIDs {
-			if i, err := strconv.Atoi(gID); err == nil {
-				og, err := g.GetGroupByGID(i)
-				if err != nil {
-					continue
-				}
-				if og != nil {
-					if r.PrimaryGroup != nil && r.PrimaryGroup.GIDNumber == og.GIDNumber {
-						continue
-					}
-
-					if !GroupExistsInList(r.OtherGroups, og) {
-						r.OtherGroups = append(r.OtherGroups, &ressources.Group{
-							ID:        og.ID,
-							Name:      og.Name,
-							GIDNumber: og.GIDNumber,
-						})
-					}
-				}
-			}
-		}
-	}
-
-	// Ajout des include groups en utilisant la fonction existante
-	includeGroups, err := g.GetIncludeGroupsByIncludeGroupGID(u.PrimaryGroup)
-	if err == nil {
-		for _, ig := range includeGroups {
-			if r.PrimaryGroup != nil && r.PrimaryGroup.GIDNumber == ig.GIDNumber {
-				continue
-			}
-
-			if !GroupExistsInList(r.OtherGroups, ig) {
-				r.OtherGroups = append(r.OtherGroups, ig)
-			}
-		}
-	}
-
-	// Ajout des capabilities en utilisant la fonction existante
-	capabilities, err := g.GetCapabilitiesByUserUIDNumber(u.UIDNumber)
-	if err == nil {
-		if capabilities != nil {
-			r.Capabilities = capabilities
-		}
-	}
-
-	return r, nil
+	return g.nextID("users", "uidnumber", g.context.userIDPolicy())
 }
 
 func (g *Glauth) GetCapabilitiesByUserUIDNumber(uid int) ([]*ressources.Capability, error) {
@@ -176,18 +84,42 @@ func (g *Glauth) GetUserByName(s string) (*ressources.User, error) {
 	var user models.User
 	err := g.db.Where("name = ?", s).First(&user).Error
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &UserError{Name: s, Err: ErrUserNotFound}
+		}
 		return nil, err
 	}
 
 	return g.userModelToResource(&user)
 }
 
+// UpdateUserPassword stores the password with the client-wide scheme
 func (g *Glauth) UpdateUserPassword(name, password string) error {
-	h := sha256.New()
-	h.Write([]byte(password))
-	pass := fmt.Sprintf("%x", h.Sum(nil))
+	return g.UpdateUserPasswordWithScheme(name, password, ressources.PasswordSchemeDefault)
+}
 
-	err := g.db.Table("users").Where("name = ?", name).Update("passsha256", pass).Error
+// UpdateUserPasswordWithScheme stores the password with the given scheme and clears the other hash column
+func (g *Glauth) UpdateUserPasswordWithScheme(name, password string, scheme ressources.PasswordScheme) error {
+	var user models.User
+	err := g.db.Where("name = ?", name).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &UserError{Name: name, Err: ErrUserNotFound}
+		}
+		return err
+	}
+
+	err = g.validatePassword(password, &user)
+	if err != nil {
+		return err
+	}
+
+	pass, err := g.hashPassword(password, scheme)
+	if err != nil {
+		return err
+	}
+
+	err = g.db.Table("users").Where("name = ?", name).Updates(pass.columns()).Error
 	if err != nil {
 		return err
 	}
@@ -195,12 +127,33 @@ func (g *Glauth) UpdateUserPassword(name, password string) error {
 	return nil
 }
 
+// UpdateUserPasswordByUID stores the password with the client-wide scheme
 func (g *Glauth) UpdateUserPasswordByUID(uid int, password string) error {
-	h := sha256.New()
-	h.Write([]byte(password))
-	pass := fmt.Sprintf("%x", h.Sum(nil))
+	return g.UpdateUserPasswordByUIDWithScheme(uid, password, ressources.PasswordSchemeDefault)
+}
 
-	err := g.db.Table("users").Where("uidnumber = ?", uid).Update("passsha256", pass).Error
+// UpdateUserPasswordByUIDWithScheme stores the password with the given scheme and clears the other hash column
+func (g *Glauth) UpdateUserPasswordByUIDWithScheme(uid int, password string, scheme ressources.PasswordScheme) error {
+	var user models.User
+	err := g.db.Where("uidnumber = ?", uid).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return &UserError{UIDNumber: uid, Err: ErrUserNotFound}
+		}
+		return err
+	}
+
+	err = g.validatePassword(password, &user)
+	if err != nil {
+		return err
+	}
+
+	pass, err := g.hashPassword(password, scheme)
+	if err != nil {
+		return err
+	}
+
+	err = g.db.Table("users").Where("uidnumber = ?", uid).Updates(pass.columns()).Error
 	if err != nil {
 		return err
 	}
@@ -208,12 +161,19 @@ func (g *Glauth) UpdateUserPasswordByUID(uid int, password string) error {
 	return nil
 }
 
+// UpdateUser updates the user and, if provided, replaces its capabilities in a single transaction
 func (g *Glauth) UpdateUser(name string, u *ressources.UpdateUser) error {
+	return g.Transaction(func(tx *Glauth) error {
+		return tx.updateUser(name, u)
+	})
+}
+
+func (g *Glauth) updateUser(name string, u *ressources.UpdateUser) error {
 	var user models.User
 	err := g.db.Table("users").Where("name = ?", name).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("user not found")
+			return &UserError{Name: name, Err: ErrUserNotFound}
 		}
 		return err
 	}
@@ -241,10 +201,30 @@ func (g *Glauth) UpdateUser(name string, u *ressources.UpdateUser) error {
 		user.OTPSecret = *u.OTPSecret
 	}
 	if u.Yubikey != nil {
-		user.Yubikey = *u.Yubikey
+		release, err := g.lockYubikeys()
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		yubikey, err := g.validateYubikey(name, *u.Yubikey)
+		if err != nil {
+			return err
+		}
+		user.Yubikey = yubikey
 	}
 	if u.SSHKeys != nil {
-		user.SSHKeys = *u.SSHKeys
+		release, err := g.lockSSHKeys()
+		if err != nil {
+			return err
+		}
+		defer release()
+
+		sshKeys, err := g.validateSSHKeys(name, *u.SSHKeys)
+		if err != nil {
+			return err
+		}
+		user.SSHKeys = sshKeys
 	}
 
 	// Update the OtherGroups field if it is provided
@@ -257,7 +237,7 @@ func (g *Glauth) UpdateUser(name string, u *ressources.UpdateUser) error {
 			}
 
 			if !exist {
-				return errors.New("group with GID " + strconv.Itoa(gID) + " does not exist")
+				return &GroupError{GIDNumber: gID, Err: ErrGroupNotFound}
 			}
 		}
 
@@ -265,7 +245,7 @@ func (g *Glauth) UpdateUser(name string, u *ressources.UpdateUser) error {
 		if user.PrimaryGroup != 0 {
 			for _, gID := range *u.OtherGroups {
 				if user.PrimaryGroup == gID {
-					return errors.New("primary group cannot be in the other groups")
+					return &UserError{Name: name, Err: ErrPrimaryInOtherList}
 				}
 			}
 		}
@@ -275,18 +255,42 @@ func (g *Glauth) UpdateUser(name string, u *ressources.UpdateUser) error {
 
 	// Update the password if provided
 	if u.Password != nil {
-		h := sha256.New()
-		h.Write([]byte(*u.Password))
-		user.PassSHA256 = fmt.Sprintf("%x", h.Sum(nil))
+		err := g.validatePassword(*u.Password, &user)
+		if err != nil {
+			return err
+		}
+
+		pass, err := g.hashPassword(*u.Password, u.PasswordScheme)
+		if err != nil {
+			return err
+		}
+
+		user.PassSHA256 = pass.SHA256
+		user.PassBCrypt = pass.BCrypt
 	}
 
 	// Validate and update Custom Attributes
 	if u.CustAttr != nil {
-		err := json.Unmarshal([]byte(*u.CustAttr), &map[string]interface{}{})
+		attrs, err := decodeCustAttr(*u.CustAttr)
 		if err != nil {
 			return err
 		}
-		user.CustAttr = *u.CustAttr
+
+		// the attributes reserved by the library, such as the recovery codes, are not replaced;
+		// an undecodable column has none to keep
+		current, _ := decodeCustAttr(user.CustAttr)
+		keepReservedCustAttrs(attrs, current)
+
+		err = g.validateCustAttr(attrs)
+		if err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(attrs)
+		if err != nil {
+			return invalidCustAttr(err)
+		}
+		user.CustAttr = string(b)
 	}
 
 	// Update the user in the database
@@ -298,7 +302,7 @@ func (g *Glauth) UpdateUser(name string, u *ressources.UpdateUser) error {
 	// Update capabilities if provided
 	if u.Capabilities != nil {
 		// Optionally clear existing capabilities or handle updates accordingly
-		if err := g.db.Where("user_id = ?", user.UIDNumber).Delete(&models.Capability{}).Error; err != nil {
+		if err := g.db.Table("capabilities").Where("userid = ?", user.UIDNumber).Delete(&models.Capability{}).Error; err != nil {
 			return err
 		}
 
@@ -321,28 +325,16 @@ func (g *Glauth) GetUsers() ([]*ressources.User, error) {
 		return nil, err
 	}
 
-	var resUsers []*ressources.User
-	for _, u := range users {
-		var r *ressources.User
-		r, err = g.userModelToResource(u)
-		if err != nil {
-			continue
-		}
-
-		if r == nil {
-			continue
-		}
-
-		resUsers = append(resUsers, r)
-	}
-
-	return resUsers, nil
+	return g.usersModelToResources(users)
 }
 
 func (g *Glauth) GetUserByUID(uid int) (*ressources.User, error) {
 	var user *models.User
 	err := g.db.Where("uidnumber = ?", uid).First(&user).Error
 	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &UserError{UIDNumber: uid, Err: ErrUserNotFound}
+		}
 		return nil, err
 	}
 
@@ -353,7 +345,16 @@ func (g *Glauth) GetUserByUID(uid int) (*ressources.User, error) {
 	return g.userModelToResource(user)
 }
 
+// CreateUser creates the user and its capabilities in a single transaction
 func (g *Glauth) CreateUser(u *ressources.CreateUser) error {
+	return g.retryAllocation(func() error {
+		return g.Transaction(func(tx *Glauth) error {
+			return tx.createUser(u)
+		})
+	})
+}
+
+func (g *Glauth) createUser(u *ressources.CreateUser) error {
 	user := &models.User{
 		Name:          u.Name,
 		OtherGroups:   []byte(ToCommaSeparatedString(u.OtherGroups)),
@@ -376,7 +377,40 @@ func (g *Glauth) CreateUser(u *ressources.CreateUser) error {
 	}
 
 	if exists {
-		return errors.New("user already exists")
+		return &UserError{Name: u.Name, Err: ErrDuplicateName}
+	}
+
+	// the named locks are always taken in the same order: uidnumber, yubikey then sshkeys
+	release, err := g.lockAllocation("uidnumber")
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if u.Yubikey != "" {
+		release, err := g.lockYubikeys()
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	user.Yubikey, err = g.validateYubikey(u.Name, u.Yubikey)
+	if err != nil {
+		return err
+	}
+
+	if u.SSHKeys != "" {
+		release, err := g.lockSSHKeys()
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	user.SSHKeys, err = g.validateSSHKeys(u.Name, u.SSHKeys)
+	if err != nil {
+		return err
 	}
 
 	if u.UIDNumber == 0 {
@@ -390,7 +424,33 @@ func (g *Glauth) CreateUser(u *ressources.CreateUser) error {
 			return err
 		}
 
+		if exists {
+			return errAllocationConflict
+		}
+
 		user.UIDNumber = id
+	} else {
+		// explicit UIDs are only restricted by a configured policy, so that legacy UIDs can be migrated
+		if policy := g.context.UserIDs; policy != nil {
+			if !policy.Contains(u.UIDNumber) {
+				return &UserError{Name: u.Name, UIDNumber: u.UIDNumber, Err: &RangeError{ID: u.UIDNumber, Min: policy.Min, Max: policy.Max}}
+			}
+
+			if policy.reserved(u.UIDNumber) {
+				return &UserError{Name: u.Name, UIDNumber: u.UIDNumber, Err: ErrIDReserved}
+			}
+		}
+
+		exists, err = g.UserExistByUID(u.UIDNumber)
+		if err != nil {
+			return err
+		}
+
+		if exists {
+			return &UserError{Name: u.Name, UIDNumber: u.UIDNumber, Err: ErrDuplicateUID}
+		}
+
+		user.UIDNumber = u.UIDNumber
 	}
 
 	if u.PrimaryGroup != 0 {
@@ -398,19 +458,45 @@ func (g *Glauth) CreateUser(u *ressources.CreateUser) error {
 	}
 
 	if u.Password != "" {
-		h := sha256.New()
-		h.Write([]byte(u.Password))
-		user.PassSHA256 = fmt.Sprintf("%x", h.Sum(nil))
+		err := g.validatePassword(u.Password, user)
+		if err != nil {
+			return err
+		}
+
+		pass, err := g.hashPassword(u.Password, u.PasswordScheme)
+		if err != nil {
+			return err
+		}
+
+		user.PassSHA256 = pass.SHA256
+		user.PassBCrypt = pass.BCrypt
 	}
 
 	if u.CustAttr != "" {
-		err := json.Unmarshal([]byte(u.CustAttr), &map[string]interface{}{})
+		attrs, err := decodeCustAttr(u.CustAttr)
+		if err != nil {
+			return err
+		}
+
+		for k := range attrs {
+			err = checkCustAttrKey(k)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = g.validateCustAttr(attrs)
 		if err != nil {
 			return err
 		}
 
 		user.CustAttr = u.CustAttr
 	} else {
+		err = g.validateCustAttr(map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+
 		user.CustAttr = "{}"
 	}
 
@@ -432,12 +518,19 @@ func (g *Glauth) CreateUser(u *ressources.CreateUser) error {
 	return nil
 }
 
+// DeleteUser deletes the user and its capabilities in a single transaction
 func (g *Glauth) DeleteUser(uid int) error {
+	return g.Transaction(func(tx *Glauth) error {
+		return tx.deleteUser(uid)
+	})
+}
+
+func (g *Glauth) deleteUser(uid int) error {
 	var user models.User
 	err := g.db.Table("users").Where("uidnumber = ?", uid).First(&user).Error
 	if err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return errors.New("user not found")
+			return &UserError{UIDNumber: uid, Err: ErrUserNotFound}
 		}
 		return err
 	}
@@ -0,0 +1,103 @@
+package glauth
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/mateo08c/go-glauth-mysql/glauth/models"
+	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	yubikeyIDLength  = 12 // modhex characters of a Yubikey public ID
+	yubikeyOTPLength = 44 // modhex characters of a Yubikey OTP: the public ID followed by the encrypted part
+	modhexAlphabet   = "cbdefghijklnrtuv"
+)
+
+var (
+	ErrInvalidYubikey     = errors.New("invalid yubikey public id or otp")
+	ErrDuplicateYubikey   = errors.New("yubikey already registered to another user")
+	ErrYubikeyLockTimeout = errors.New("timed out waiting for the yubikey lock")
+)
+
+// YubikeyPublicID returns the 12 characters public ID of a Yubikey given either the ID itself or a
+// full OTP generated by the key
+func YubikeyPublicID(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+
+	if len(s) != yubikeyIDLength && len(s) != yubikeyOTPLength {
+		return "", ErrInvalidYubikey
+	}
+
+	for _, r := range s {
+		if !strings.ContainsRune(modhexAlphabet, r) {
+			return "", ErrInvalidYubikey
+		}
+	}
+
+	return s[:yubikeyIDLength], nil
+}
+
+// GetUserByYubikey returns the user the Yubikey is registered to, given its public ID or an OTP
+func (g *Glauth) GetUserByYubikey(yubikey string) (*ressources.User, error) {
+	id, err := YubikeyPublicID(yubikey)
+	if err != nil {
+		return nil, err
+	}
+
+	var user models.User
+	err = g.db.Where("yubikey = ?", id).First(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, &UserError{Err: ErrUserNotFound}
+		}
+		return nil, err
+	}
+
+	return g.userModelToResource(&user)
+}
+
+// lockYubikeys serializes the registration of Yubikeys across clients, see lockAllocation. It is
+// held until the user row is written, so that validateYubikey waits for concurrent registrations.
+func (g *Glauth) lockYubikeys() (func(), error) {
+	release, acquired, err := g.getLock("yubikey")
+	if err != nil {
+		return nil, err
+	}
+
+	if !acquired {
+		return nil, ErrYubikeyLockTimeout
+	}
+
+	return release, nil
+}
+
+// validateYubikey normalizes the Yubikey given for the user to its public ID and checks it is not
+// registered to another user. An empty value is left as is, it removes the key. The caller holds
+// lockYubikeys.
+func (g *Glauth) validateYubikey(name, yubikey string) (string, error) {
+	if yubikey == "" {
+		return "", nil
+	}
+
+	id, err := YubikeyPublicID(yubikey)
+	if err != nil {
+		return "", &UserError{Name: name, Err: err}
+	}
+
+	// a locking read, to wait for the uncommitted row of the previous holder of the lock
+	var names []string
+	err = g.db.Table("users").Clauses(clause.Locking{Strength: "UPDATE"}).
+		Where("yubikey = ? AND name <> ?", id, name).Pluck("name", &names).Error
+	if err != nil {
+		return "", err
+	}
+
+	if len(names) > 0 {
+		return "", &UserError{Name: name, Err: ErrDuplicateYubikey}
+	}
+
+	return id, nil
+}
@@ -3,14 +3,19 @@ module github.com/mateo08c/go-glauth-mysql
 go 1.22
 
 require (
+	github.com/go-sql-driver/mysql v1.7.0
+	github.com/joho/godotenv v1.5.1
+	github.com/pquerna/otp v1.4.0
+	github.com/santhosh-tekuri/jsonschema/v5 v5.3.1
+	golang.org/x/crypto v0.32.0
 	gorm.io/driver/mysql v1.5.7
 	gorm.io/gorm v1.25.11
 )
 
 require (
-	github.com/go-sql-driver/mysql v1.7.0 // indirect
+	github.com/boombuler/barcode v1.0.1-0.20190219062509-6c824513bacc // indirect
 	github.com/jinzhu/inflection v1.0.0 // indirect
 	github.com/jinzhu/now v1.1.5 // indirect
-	github.com/joho/godotenv v1.5.1 // indirect
-	golang.org/x/text v0.14.0 // indirect
+	golang.org/x/sys v0.29.0 // indirect
+	golang.org/x/text v0.21.0 // indirect
 )
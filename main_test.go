@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
 	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/mateo08c/go-glauth-mysql/glauth"
 	"github.com/mateo08c/go-glauth-mysql/glauth/ressources"
-	"gorm.io/gorm"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/ssh"
+	"gorm.io/gorm/logger"
 	"log"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
-var context *glauth.Context
+var glauthContext *glauth.Context
 
 // start on init
 func init() {
@@ -20,7 +32,7 @@ func init() {
 		log.Println("Loaded from .env file")
 	}
 
-	context = &glauth.Context{
+	glauthContext = &glauth.Context{
 		Username: os.Getenv("DB_USERNAME"),
 		Password: os.Getenv("DB_PASSWORD"),
 		Hostname: os.Getenv("DB_HOSTNAME"),
@@ -29,8 +41,52 @@ func init() {
 	}
 }
 
+// newTestClient returns a client connected with c, failing the test otherwise
+func newTestClient(t testing.TB, c *glauth.Context) *glauth.Glauth {
+	t.Helper()
+
+	client, err := glauth.New(c)
+	if err != nil {
+		t.Fatalf("Failed to create client: %v", err)
+	}
+
+	return client
+}
+
+// newTestUser creates the user and returns it as stored, it is deleted at the end of the test
+func newTestUser(t testing.TB, client *glauth.Glauth, u *ressources.CreateUser) *ressources.User {
+	t.Helper()
+
+	err := client.CreateUser(u)
+	if err != nil {
+		t.Fatalf("Failed to create user %s: %v", u.Name, err)
+	}
+
+	user, err := client.GetUserByName(u.Name)
+	if err != nil {
+		t.Fatalf("Failed to get user %s: %v", u.Name, err)
+	}
+	t.Cleanup(func() { client.DeleteUser(user.UIDNumber) })
+
+	return user
+}
+
+// newTestGroups creates n groups named prefix-i with the GIDs base+i, they are deleted at the end of the test
+func newTestGroups(t testing.TB, client *glauth.Glauth, prefix string, base, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		gid := base + i
+		err := client.CreateGroup(&ressources.CreateGroup{Name: fmt.Sprintf("%s-%d", prefix, i), GIDNumber: gid})
+		if err != nil {
+			t.Fatalf("Failed to create group %s-%d: %v", prefix, i, err)
+		}
+		t.Cleanup(func() { client.DeleteGroup(gid) })
+	}
+}
+
 func TestNew(t *testing.T) {
-	client, err := glauth.New(context)
+	client, err := glauth.New(glauthContext)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -38,8 +94,30 @@ func TestNew(t *testing.T) {
 	t.Log(client)
 }
 
+func TestWithContext(t *testing.T) {
+	client, err := glauth.New(glauthContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = client.WithContext(ctx).GetUsers()
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+
+	users, err := client.WithContext(context.Background()).GetUsers()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Log(users)
+}
+
 func TestGroup(t *testing.T) {
-	client, err := glauth.New(context)
+	client, err := glauth.New(glauthContext)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,12 +149,8 @@ func TestGroup(t *testing.T) {
 
 	//try to get the group
 	group, err = client.GetGroupByName("test")
-	if err == nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			t.Log("Group not found")
-		} else {
-			t.Fatal(err)
-		}
+	if !errors.Is(err, glauth.ErrGroupNotFound) {
+		t.Fatalf("Expected group to be not found after deletion, got %v", err)
 	}
 
 	t.Log(group)
@@ -94,8 +168,48 @@ func TestGroup(t *testing.T) {
 	t.Log(groups)
 }
 
+func TestTransaction(t *testing.T) {
+	client, err := glauth.New(glauthContext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rollback := errors.New("rollback")
+	err = client.Transaction(func(tx *glauth.Glauth) error {
+		err := tx.CreateGroup(&ressources.CreateGroup{Name: "test-tx"})
+		if err != nil {
+			return err
+		}
+
+		group, err := tx.GetGroupByName("test-tx")
+		if err != nil {
+			return err
+		}
+
+		err = tx.CreateUser(&ressources.CreateUser{Name: "test-tx", PrimaryGroup: group.GIDNumber})
+		if err != nil {
+			return err
+		}
+
+		return rollback
+	})
+	if !errors.Is(err, rollback) {
+		t.Fatalf("Expected rollback error, got %v", err)
+	}
+
+	_, err = client.GetGroupByName("test-tx")
+	if !errors.Is(err, glauth.ErrGroupNotFound) {
+		t.Fatalf("Expected group to be rolled back, got %v", err)
+	}
+
+	_, err = client.GetUserByName("test-tx")
+	if !errors.Is(err, glauth.ErrUserNotFound) {
+		t.Fatalf("Expected user to be rolled back, got %v", err)
+	}
+}
+
 func TestUser(t *testing.T) {
-	client, err := glauth.New(context)
+	client, err := glauth.New(glauthContext)
 	if err != nil {
 		t.Fatalf("Failed to create client: %v", err)
 	}
@@ -146,7 +260,7 @@ func TestUser(t *testing.T) {
 		t.Log("User updated")
 
 		user, err := client.GetUserByName("test")
-		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		if err != nil && !errors.Is(err, glauth.ErrUserNotFound) {
 			t.Fatalf("Unexpected error when getting updated user: %v", err)
 		}
 
@@ -165,9 +279,1291 @@ func TestUser(t *testing.T) {
 		t.Log("User deleted")
 
 		user, err = client.GetUserByName("test")
-		if err == nil || !errors.Is(err, gorm.ErrRecordNotFound) {
+		if err == nil || !errors.Is(err, glauth.ErrUserNotFound) {
 			t.Fatalf("Expected user to be not found after deletion, got %v", err)
 		}
 		t.Log("User not found after deletion")
 	})
 }
+
+func TestConcurrentCreateUser(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	const n = 10
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("test-concurrent-%d", i)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			errs[i] = client.CreateUser(&ressources.CreateUser{Name: name})
+		}(i, name)
+	}
+	wg.Wait()
+
+	uids := make(map[int]string)
+	for i, name := range names {
+		if errs[i] != nil {
+			t.Errorf("Failed to create user %s: %v", name, errs[i])
+			continue
+		}
+
+		user, err := client.GetUserByName(name)
+		if err != nil {
+			t.Errorf("Failed to get user %s: %v", name, err)
+			continue
+		}
+
+		if other, ok := uids[user.UIDNumber]; ok {
+			t.Errorf("Users %s and %s got the same UID %d", other, name, user.UIDNumber)
+		}
+		uids[user.UIDNumber] = name
+
+		err = client.DeleteUser(user.UIDNumber)
+		if err != nil {
+			t.Errorf("Failed to delete user %s: %v", name, err)
+		}
+	}
+}
+
+func TestIDPolicy(t *testing.T) {
+	c := *glauthContext
+	c.UserIDs = &glauth.IDPolicy{
+		Min:      900000,
+		Max:      900001,
+		Strategy: glauth.AllocateFillGaps,
+		Reserved: []int{900000},
+	}
+
+	client := newTestClient(t, &c)
+
+	user := newTestUser(t, client, &ressources.CreateUser{Name: "test-policy-1"})
+
+	if user.UIDNumber != 900001 {
+		t.Fatalf("Expected UID 900001, got %d", user.UIDNumber)
+	}
+
+	err := client.CreateUser(&ressources.CreateUser{Name: "test-policy-2"})
+	if !errors.Is(err, glauth.ErrIDRangeExhausted) {
+		t.Fatalf("Expected range to be exhausted, got %v", err)
+	}
+}
+
+func TestCreateUserExplicitUID(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	err := client.CreateUser(&ressources.CreateUser{Name: "test-uid-1", UIDNumber: 950000})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer client.DeleteUser(950000)
+
+	user, err := client.GetUserByName("test-uid-1")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if user.UIDNumber != 950000 {
+		t.Fatalf("Expected UID 950000, got %d", user.UIDNumber)
+	}
+
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-uid-2", UIDNumber: 950000})
+	if !errors.Is(err, glauth.ErrDuplicateUID) {
+		t.Fatalf("Expected duplicate UID error, got %v", err)
+	}
+
+	// without a configured policy, legacy UIDs below the default range are accepted
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-uid-legacy", UIDNumber: 9501})
+	if err != nil {
+		t.Fatalf("Failed to create user with a legacy UID: %v", err)
+	}
+	defer client.DeleteUser(9501)
+
+	c := *glauthContext
+	c.UserIDs = &glauth.IDPolicy{Min: 950000, Max: 950010, Reserved: []int{950005}}
+
+	client = newTestClient(t, &c)
+
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-uid-3", UIDNumber: 100})
+	if !errors.Is(err, glauth.ErrIDOutOfRange) {
+		t.Fatalf("Expected out of range error, got %v", err)
+	}
+
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-uid-4", UIDNumber: 950005})
+	if !errors.Is(err, glauth.ErrIDReserved) {
+		t.Fatalf("Expected reserved error, got %v", err)
+	}
+}
+
+func TestPasswordScheme(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	user := newTestUser(t, client, &ressources.CreateUser{
+		Name:           "test-bcrypt",
+		Password:       "password",
+		PasswordScheme: ressources.PasswordSchemeBCrypt,
+	})
+
+	if user.PassBCrypt == "" || user.PassSHA256 != "" {
+		t.Fatalf("Expected only passbcrypt to be set, got sha256=%q bcrypt=%q", user.PassSHA256, user.PassBCrypt)
+	}
+
+	err := client.UpdateUserPasswordWithScheme("test-bcrypt", "password", ressources.PasswordSchemeSHA256)
+	if err != nil {
+		t.Fatalf("Failed to update password: %v", err)
+	}
+
+	user, err = client.GetUserByName("test-bcrypt")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if user.PassSHA256 == "" || user.PassBCrypt != "" {
+		t.Fatalf("Expected only passsha256 to be set, got sha256=%q bcrypt=%q", user.PassSHA256, user.PassBCrypt)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	secret := "JBSWY3DPEHPK3PXP"
+	for _, scheme := range []ressources.PasswordScheme{ressources.PasswordSchemeSHA256, ressources.PasswordSchemeBCrypt} {
+		t.Run(scheme.String(), func(t *testing.T) {
+			newTestUser(t, client, &ressources.CreateUser{
+				Name:           "test-auth",
+				Password:       "password",
+				PasswordScheme: scheme,
+			})
+
+			_, err := client.Authenticate("test-auth", "password", "")
+			if err != nil {
+				t.Fatalf("Failed to authenticate: %v", err)
+			}
+
+			var authErr *glauth.AuthError
+			_, err = client.Authenticate("test-auth", "wrong", "")
+			if !errors.As(err, &authErr) || authErr.Reason != glauth.AuthBadPassword {
+				t.Fatalf("Expected bad password, got %v", err)
+			}
+
+			err = client.UpdateUser("test-auth", &ressources.UpdateUser{OTPSecret: &secret})
+			if err != nil {
+				t.Fatalf("Failed to update user: %v", err)
+			}
+
+			_, err = client.Authenticate("test-auth", "password", "")
+			if !errors.Is(err, glauth.ErrOTPRequired) {
+				t.Fatalf("Expected otp required, got %v", err)
+			}
+
+			_, err = client.Authenticate("test-auth", "password000000", "")
+			if !errors.Is(err, glauth.ErrOTPInvalid) {
+				t.Fatalf("Expected otp invalid, got %v", err)
+			}
+
+			code, err := totp.GenerateCode(secret, time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = client.Authenticate("test-auth", "password"+code, "")
+			if err != nil {
+				t.Fatalf("Failed to authenticate with appended otp: %v", err)
+			}
+
+			disabled := true
+			err = client.UpdateUser("test-auth", &ressources.UpdateUser{Disabled: &disabled})
+			if err != nil {
+				t.Fatalf("Failed to update user: %v", err)
+			}
+
+			_, err = client.Authenticate("test-auth", "password", code)
+			if !errors.Is(err, glauth.ErrUserDisabled) {
+				t.Fatalf("Expected user disabled, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRehashSHA256(t *testing.T) {
+	c := *glauthContext
+	c.RehashSHA256 = true
+
+	client := newTestClient(t, &c)
+
+	newTestUser(t, client, &ressources.CreateUser{
+		Name:           "test-rehash",
+		Password:       "password",
+		PasswordScheme: ressources.PasswordSchemeSHA256,
+	})
+
+	_, err := client.Authenticate("test-rehash", "password", "")
+	if err != nil {
+		t.Fatalf("Failed to authenticate: %v", err)
+	}
+
+	user, err := client.GetUserByName("test-rehash")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if user.PassBCrypt == "" || user.PassSHA256 != "" {
+		t.Fatalf("Expected password to be rehashed to bcrypt, got sha256=%q bcrypt=%q", user.PassSHA256, user.PassBCrypt)
+	}
+
+	_, err = client.Authenticate("test-rehash", "password", "")
+	if err != nil {
+		t.Fatalf("Failed to authenticate after rehash: %v", err)
+	}
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	c := *glauthContext
+	c.PasswordPolicy = &glauth.BasicPasswordPolicy{
+		MinLength:              16,
+		RequireDigit:           true,
+		DisallowUserAttributes: true,
+	}
+
+	client := newTestClient(t, &c)
+
+	err := client.CreateUser(&ressources.CreateUser{Name: "test-pwpolicy", Password: "test-pwpolicy"})
+	var policyErr *glauth.PasswordPolicyError
+	if !errors.As(err, &policyErr) {
+		t.Fatalf("Expected password policy error, got %v", err)
+	}
+
+	rules := make(map[string]string)
+	for _, v := range policyErr.Violations {
+		rules[v.Rule] = v.Field
+	}
+
+	for _, rule := range []string{"min_length", "require_digit", "user_attribute"} {
+		if _, ok := rules[rule]; !ok {
+			t.Errorf("Expected violation of rule %s, got %v", rule, policyErr.Violations)
+		}
+	}
+
+	if rules["user_attribute"] != "name" {
+		t.Errorf("Expected user_attribute violation on name, got %q", rules["user_attribute"])
+	}
+
+	newTestUser(t, client, &ressources.CreateUser{Name: "test-pwpolicy", Password: "correct horse 42"})
+
+	err = client.UpdateUserPassword("test-pwpolicy", "")
+	if !errors.Is(err, glauth.ErrPasswordPolicy) {
+		t.Fatalf("Expected empty password to be refused, got %v", err)
+	}
+}
+
+func TestTOTPEnrollment(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	user := newTestUser(t, client, &ressources.CreateUser{Name: "test-totp"})
+
+	enrollment, err := client.EnrollTOTP("test-totp", "glauth")
+	if err != nil {
+		t.Fatalf("Failed to enroll: %v", err)
+	}
+
+	if !strings.HasPrefix(enrollment.URI, "otpauth://totp/") {
+		t.Fatalf("Unexpected provisioning URI %s", enrollment.URI)
+	}
+
+	if !bytes.HasPrefix(enrollment.QRCode, []byte("\x89PNG")) {
+		t.Fatal("Expected QR code to be a PNG")
+	}
+
+	user, err = client.GetUserByName("test-totp")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if user.OTPSecret != "" || strings.Contains(user.CustAttr, enrollment.Secret) {
+		t.Fatal("Expected secret not to be stored on the user before confirmation")
+	}
+
+	code, err := totp.GenerateCode(enrollment.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the enrollment is stored in the totpenrollments table, so another client can confirm it
+	other := newTestClient(t, glauthContext)
+
+	err = other.ConfirmTOTP("test-totp", code)
+	if err != nil {
+		t.Fatalf("Failed to confirm: %v", err)
+	}
+
+	user, err = client.GetUserByName("test-totp")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if user.OTPSecret != enrollment.Secret {
+		t.Fatal("Expected secret to be stored after confirmation")
+	}
+
+	err = client.ConfirmTOTP("test-totp", code)
+	if !errors.Is(err, glauth.ErrNoTOTPEnrollment) {
+		t.Fatalf("Expected the enrollment to be cleared on confirmation, got %v", err)
+	}
+
+	_, err = client.EnrollTOTP("test-totp", "glauth")
+	if err != nil {
+		t.Fatalf("Failed to enroll: %v", err)
+	}
+
+	err = client.DisableTOTP("test-totp")
+	if err != nil {
+		t.Fatalf("Failed to disable: %v", err)
+	}
+
+	err = client.ConfirmTOTP("test-totp", code)
+	if !errors.Is(err, glauth.ErrNoTOTPEnrollment) {
+		t.Fatalf("Expected no pending enrollment, got %v", err)
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	newTestUser(t, client, &ressources.CreateUser{Name: "test-recovery"})
+
+	codes, err := client.GenerateRecoveryCodes("test-recovery", 3)
+	if err != nil {
+		t.Fatalf("Failed to generate recovery codes: %v", err)
+	}
+
+	_, err = client.GenerateRecoveryCodes("test-recovery", 3)
+	if !errors.Is(err, glauth.ErrRecoveryCodesExist) {
+		t.Fatalf("Expected recovery codes to exist, got %v", err)
+	}
+
+	err = client.ConsumeRecoveryCode("test-recovery", strings.ToUpper(codes[1]))
+	if err != nil {
+		t.Fatalf("Failed to consume recovery code: %v", err)
+	}
+
+	err = client.ConsumeRecoveryCode("test-recovery", codes[1])
+	if !errors.Is(err, glauth.ErrInvalidRecoveryCode) {
+		t.Fatalf("Expected consumed code to be refused, got %v", err)
+	}
+
+	remaining, err := client.RemainingRecoveryCodes("test-recovery")
+	if err != nil {
+		t.Fatalf("Failed to count recovery codes: %v", err)
+	}
+
+	if remaining != 2 {
+		t.Fatalf("Expected 2 remaining recovery codes, got %d", remaining)
+	}
+
+	// the recovery codes are managed by the library only
+	err = client.SetCustAttr("test-recovery", glauth.RecoveryCodesAttr, []string{"known hash"})
+	if !errors.Is(err, glauth.ErrInvalidCustAttr) {
+		t.Fatalf("Expected reserved attribute to be refused, got %v", err)
+	}
+
+	err = client.DeleteCustAttr("test-recovery", glauth.RecoveryCodesAttr)
+	if !errors.Is(err, glauth.ErrInvalidCustAttr) {
+		t.Fatalf("Expected reserved attribute to be refused, got %v", err)
+	}
+
+	err = client.PatchCustAttr("test-recovery", []byte(`{"otpRecoveryCodes":null}`))
+	if !errors.Is(err, glauth.ErrInvalidCustAttr) {
+		t.Fatalf("Expected reserved attribute to be refused, got %v", err)
+	}
+
+	custAttr := `{"department":"it"}`
+	err = client.UpdateUser("test-recovery", &ressources.UpdateUser{CustAttr: &custAttr})
+	if err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+
+	remaining, err = client.RemainingRecoveryCodes("test-recovery")
+	if err != nil {
+		t.Fatalf("Failed to count recovery codes: %v", err)
+	}
+
+	if remaining != 2 {
+		t.Fatalf("Expected the recovery codes to be kept, got %d", remaining)
+	}
+
+	_, err = client.RegenerateRecoveryCodes("test-recovery", 5)
+	if err != nil {
+		t.Fatalf("Failed to regenerate recovery codes: %v", err)
+	}
+
+	err = client.ConsumeRecoveryCode("test-recovery", codes[0])
+	if !errors.Is(err, glauth.ErrInvalidRecoveryCode) {
+		t.Fatalf("Expected old code to be refused after regeneration, got %v", err)
+	}
+}
+
+func TestYubikey(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	id := "vvccccdbdebu"
+	otp := id + strings.Repeat("tnlgedjlftrbdeut", 2)
+
+	publicID, err := glauth.YubikeyPublicID(otp)
+	if err != nil || publicID != id {
+		t.Fatalf("Expected public id %s, got %s (%v)", id, publicID, err)
+	}
+
+	_, err = glauth.YubikeyPublicID("not-a-yubikey")
+	if !errors.Is(err, glauth.ErrInvalidYubikey) {
+		t.Fatalf("Expected invalid yubikey, got %v", err)
+	}
+
+	newTestUser(t, client, &ressources.CreateUser{Name: "test-yubikey-1", Yubikey: otp})
+
+	user, err := client.GetUserByYubikey(id)
+	if err != nil {
+		t.Fatalf("Failed to get user by yubikey: %v", err)
+	}
+
+	if user.Name != "test-yubikey-1" || user.Yubikey != id {
+		t.Fatalf("Expected test-yubikey-1 with yubikey %s, got %s with %s", id, user.Name, user.Yubikey)
+	}
+
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-yubikey-2", Yubikey: id})
+	if !errors.Is(err, glauth.ErrDuplicateYubikey) {
+		t.Fatalf("Expected duplicate yubikey, got %v", err)
+	}
+
+	var userErr *glauth.UserError
+	_, err = client.GetUserByYubikey("cccccccccccb")
+	if !errors.As(err, &userErr) || !errors.Is(err, glauth.ErrUserNotFound) {
+		t.Fatalf("Expected user not found, got %v", err)
+	}
+}
+
+func TestConcurrentYubikey(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	const n = 5
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = client.CreateUser(&ressources.CreateUser{Name: fmt.Sprintf("test-yubikey-concurrent-%d", i), Yubikey: "vvccccdbdebv"})
+		}(i)
+	}
+	wg.Wait()
+
+	created := 0
+	for i, err := range errs {
+		if err == nil {
+			created++
+			user, err := client.GetUserByName(fmt.Sprintf("test-yubikey-concurrent-%d", i))
+			if err != nil {
+				t.Fatalf("Failed to get user: %v", err)
+			}
+			defer client.DeleteUser(user.UIDNumber)
+			continue
+		}
+
+		if !errors.Is(err, glauth.ErrDuplicateYubikey) {
+			t.Errorf("Expected duplicate yubikey, got %v", err)
+		}
+	}
+
+	if created != 1 {
+		t.Fatalf("Expected the yubikey to be registered once, got %d users", created)
+	}
+}
+
+func TestSSHKeys(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	authorizedKey := func(t *testing.T, key interface{}, comment string) string {
+		t.Helper()
+		pub, err := ssh.NewPublicKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pub))) + " " + comment
+	}
+
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newTestUser(t, client, &ressources.CreateUser{Name: "test-ssh-1"})
+
+	key, err := client.AddSSHKey("test-ssh-1", authorizedKey(t, edPub, "test@example.com"))
+	if err != nil {
+		t.Fatalf("Failed to add ssh key: %v", err)
+	}
+
+	if key.Type != ssh.KeyAlgoED25519 || key.Bits != 256 || key.Comment != "test@example.com" {
+		t.Fatalf("Unexpected parsed key %+v", key)
+	}
+
+	for _, k := range []string{
+		`command="/bin/false" ` + authorizedKey(t, edPub, "restricted"),
+		`from="10.0.0.1" ` + authorizedKey(t, edPub, "restricted"),
+		authorizedKey(t, edPub, "first") + "\n" + authorizedKey(t, &rsaKey.PublicKey, "second"),
+	} {
+		_, err = client.AddSSHKey("test-ssh-1", k)
+		if !errors.Is(err, glauth.ErrInvalidSSHKey) {
+			t.Fatalf("Expected %q to be refused, got %v", k, err)
+		}
+	}
+
+	_, err = client.AddSSHKey("test-ssh-1", authorizedKey(t, &rsaKey.PublicKey, "weak"))
+	if !errors.Is(err, glauth.ErrWeakSSHKey) {
+		t.Fatalf("Expected weak key to be refused, got %v", err)
+	}
+
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-ssh-2", SSHKeys: authorizedKey(t, edPub, "other")})
+	if !errors.Is(err, glauth.ErrDuplicateSSHKey) {
+		t.Fatalf("Expected duplicate key to be refused, got %v", err)
+	}
+
+	keys, err := client.ListSSHKeys("test-ssh-1")
+	if err != nil {
+		t.Fatalf("Failed to list ssh keys: %v", err)
+	}
+
+	if len(keys) != 1 || keys[0].Fingerprint != key.Fingerprint {
+		t.Fatalf("Expected the added key, got %v", keys)
+	}
+
+	err = client.RemoveSSHKey("test-ssh-1", key.Fingerprint)
+	if err != nil {
+		t.Fatalf("Failed to remove ssh key: %v", err)
+	}
+
+	err = client.RemoveSSHKey("test-ssh-1", key.Fingerprint)
+	if !errors.Is(err, glauth.ErrSSHKeyNotFound) {
+		t.Fatalf("Expected key not to be found, got %v", err)
+	}
+}
+
+func TestConcurrentSSHKeys(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := string(ssh.MarshalAuthorizedKey(sshPub))
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		newTestUser(t, client, &ressources.CreateUser{Name: fmt.Sprintf("test-ssh-concurrent-%d", i)})
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = client.AddSSHKey(fmt.Sprintf("test-ssh-concurrent-%d", i), key)
+		}(i)
+	}
+	wg.Wait()
+
+	added := 0
+	for _, err := range errs {
+		if err == nil {
+			added++
+		} else if !errors.Is(err, glauth.ErrDuplicateSSHKey) {
+			t.Errorf("Expected duplicate key, got %v", err)
+		}
+	}
+
+	if added != 1 {
+		t.Fatalf("Expected the key to be added once, got %d", added)
+	}
+}
+
+func TestCustAttr(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	newTestUser(t, client, &ressources.CreateUser{Name: "test-custattr", CustAttr: `{"department":"it","badge":{"id":1,"color":"red"}}`})
+
+	err := client.SetCustAttr("test-custattr", "employeeNumber", 42)
+	if err != nil {
+		t.Fatalf("Failed to set attribute: %v", err)
+	}
+
+	err = client.PatchCustAttr("test-custattr", []byte(`{"department":null,"badge":{"color":"blue"}}`))
+	if err != nil {
+		t.Fatalf("Failed to patch attributes: %v", err)
+	}
+
+	err = client.PatchCustAttr("test-custattr", []byte(`[1,2]`))
+	if !errors.Is(err, glauth.ErrInvalidCustAttr) {
+		t.Fatalf("Expected invalid patch to be refused, got %v", err)
+	}
+
+	attrs, err := client.GetCustAttr("test-custattr")
+	if err != nil {
+		t.Fatalf("Failed to get attributes: %v", err)
+	}
+
+	if _, ok := attrs["department"]; ok {
+		t.Fatalf("Expected department to be removed, got %v", attrs)
+	}
+
+	type badge struct {
+		ID    int    `json:"id"`
+		Color string `json:"color"`
+	}
+	type attributes struct {
+		EmployeeNumber int   `json:"employeeNumber"`
+		Badge          badge `json:"badge"`
+	}
+
+	typed, err := glauth.GetCustAttrAs[attributes](client, "test-custattr")
+	if err != nil {
+		t.Fatalf("Failed to decode attributes: %v", err)
+	}
+
+	if typed.EmployeeNumber != 42 || typed.Badge != (badge{ID: 1, Color: "blue"}) {
+		t.Fatalf("Unexpected attributes %+v", typed)
+	}
+
+	err = client.DeleteCustAttr("test-custattr", "badge")
+	if err != nil {
+		t.Fatalf("Failed to delete attribute: %v", err)
+	}
+
+	attrs, err = client.GetCustAttr("test-custattr")
+	if err != nil {
+		t.Fatalf("Failed to get attributes: %v", err)
+	}
+
+	if len(attrs) != 1 {
+		t.Fatalf("Expected only employeeNumber to remain, got %v", attrs)
+	}
+}
+
+func TestCustAttrSchema(t *testing.T) {
+	schema, err := glauth.NewJSONSchema([]byte(`{
+		"type": "object",
+		"properties": {"employeeNumber": {"type": "integer"}}
+	}`))
+	if err != nil {
+		t.Fatalf("Failed to compile schema: %v", err)
+	}
+
+	c := *glauthContext
+	c.CustAttrSchema = schema
+
+	client := newTestClient(t, &c)
+
+	unchecked := newTestClient(t, glauthContext)
+
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-schema", CustAttr: `{"employeeNumber":"42"}`})
+	var schemaErr *glauth.CustAttrSchemaError
+	if !errors.As(err, &schemaErr) || schemaErr.Violations[0].Path != "/employeeNumber" {
+		t.Fatalf("Expected schema violation on /employeeNumber, got %v", err)
+	}
+
+	newTestUser(t, unchecked, &ressources.CreateUser{Name: "test-schema", CustAttr: `{"employeeNumber":"42"}`})
+
+	reports, err := client.ValidateAllCustAttrs()
+	if err != nil {
+		t.Fatalf("Failed to validate attributes: %v", err)
+	}
+
+	found := false
+	for _, r := range reports {
+		if r.Name == "test-schema" {
+			found = errors.Is(r.Err, glauth.ErrInvalidCustAttr)
+		}
+	}
+
+	if !found {
+		t.Fatalf("Expected test-schema to be reported, got %v", reports)
+	}
+
+	err = client.SetCustAttr("test-schema", "employeeNumber", 42)
+	if err != nil {
+		t.Fatalf("Failed to set attribute: %v", err)
+	}
+
+	type attributes struct {
+		EmployeeNumber int `json:"employeeNumber"`
+	}
+
+	c.CustAttrSchema = glauth.NewStructSchema[attributes](true)
+	strict := newTestClient(t, &c)
+
+	err = strict.SetCustAttr("test-schema", "nickname", "tester")
+	if !errors.Is(err, glauth.ErrInvalidCustAttr) {
+		t.Fatalf("Expected unknown attribute to be refused, got %v", err)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	err := client.CreateGroup(&ressources.CreateGroup{Name: "test-search"})
+	if err != nil {
+		t.Fatalf("Failed to create group: %v", err)
+	}
+
+	group, err := client.GetGroupByName("test-search")
+	if err != nil {
+		t.Fatalf("Failed to get group: %v", err)
+	}
+	// cleaned up after the users referencing it
+	t.Cleanup(func() { client.DeleteGroup(group.GIDNumber) })
+
+	for _, u := range []*ressources.CreateUser{
+		{Name: "test-search-1", Mail: "one@example.com", CustAttr: `{"department":"it","floor":42,"badge":{"color":"red"}}`, OtherGroups: []int{group.GIDNumber}},
+		{Name: "test-search-2", Mail: "two@example.com", CustAttr: `{"department":"sales","floor":"42"}`},
+		{Name: "test-search-3", Mail: "three@example.org", Disabled: true},
+	} {
+		newTestUser(t, client, u)
+	}
+
+	disabled := false
+	tests := []struct {
+		name  string
+		query *ressources.UserQuery
+		want  []string
+	}{
+		{"prefix", &ressources.UserQuery{Name: &ressources.StringFilter{Value: "test-search-", Match: ressources.MatchPrefix}}, []string{"test-search-1", "test-search-2", "test-search-3"}},
+		{"contains", &ressources.UserQuery{Name: &ressources.StringFilter{Value: "search-"}, Mail: &ressources.StringFilter{Value: "example.com", Match: ressources.MatchContains}}, nil},
+		{"enabled", &ressources.UserQuery{Name: &ressources.StringFilter{Value: "test-search-", Match: ressources.MatchPrefix}, Disabled: &disabled}, []string{"test-search-1", "test-search-2"}},
+		{"member", &ressources.UserQuery{MemberOf: &group.GIDNumber}, []string{"test-search-1"}},
+		{"custattr", &ressources.UserQuery{CustAttr: []ressources.CustAttrFilter{{Key: "department", Value: "sales"}}}, []string{"test-search-2"}},
+		{"custattr number", &ressources.UserQuery{CustAttr: []ressources.CustAttrFilter{{Key: "floor", Value: 42}}}, []string{"test-search-1"}},
+		{"custattr string", &ressources.UserQuery{CustAttr: []ressources.CustAttrFilter{{Key: "floor", Value: "42"}}}, []string{"test-search-2"}},
+		{"custattr object", &ressources.UserQuery{CustAttr: []ressources.CustAttrFilter{{Key: "badge", Value: map[string]string{"color": "red"}}}}, []string{"test-search-1"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := client.SearchUsers(tt.query)
+			if err != nil {
+				t.Fatalf("Failed to search users: %v", err)
+			}
+
+			var names []string
+			for _, u := range users {
+				names = append(names, u.Name)
+			}
+
+			if fmt.Sprint(names) != fmt.Sprint(tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, names)
+			}
+		})
+	}
+}
+
+func TestPagination(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	for i := 0; i < 5; i++ {
+		uid := 960000 + i
+		err := client.CreateUser(&ressources.CreateUser{Name: fmt.Sprintf("test-page-%d", i), UIDNumber: uid})
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		defer client.DeleteUser(uid)
+	}
+
+	query := &ressources.UserQuery{Name: &ressources.StringFilter{Value: "test-page-", Match: ressources.MatchPrefix}}
+
+	for _, order := range []ressources.SortOrder{ressources.SortAscending, ressources.SortDescending} {
+		var uids []int
+		opts := &ressources.PageOptions{Limit: 2, Order: order}
+		for {
+			page, err := client.SearchUsersPage(query, opts)
+			if err != nil {
+				t.Fatalf("Failed to get page: %v", err)
+			}
+
+			if page.Total != 5 {
+				t.Fatalf("Expected a total of 5 users, got %d", page.Total)
+			}
+
+			for _, u := range page.Users {
+				uids = append(uids, u.UIDNumber)
+			}
+
+			if page.NextCursor == "" {
+				break
+			}
+			opts.Cursor = page.NextCursor
+		}
+
+		want := []int{960000, 960001, 960002, 960003, 960004}
+		if order == ressources.SortDescending {
+			want = []int{960004, 960003, 960002, 960001, 960000}
+		}
+
+		if fmt.Sprint(uids) != fmt.Sprint(want) {
+			t.Fatalf("Expected %v, got %v", want, uids)
+		}
+	}
+
+	page, err := client.SearchUsersPage(query, &ressources.PageOptions{Limit: 2})
+	if err != nil {
+		t.Fatalf("Failed to get page: %v", err)
+	}
+
+	_, err = client.SearchUsersPage(query, &ressources.PageOptions{Limit: 2, Cursor: page.NextCursor, Order: ressources.SortDescending})
+	if !errors.Is(err, glauth.ErrInvalidCursor) {
+		t.Fatalf("Expected invalid cursor for another order, got %v", err)
+	}
+
+	_, err = client.GetGroupsPage(&ressources.PageOptions{Cursor: "not a cursor"})
+	if !errors.Is(err, glauth.ErrInvalidCursor) {
+		t.Fatalf("Expected invalid cursor, got %v", err)
+	}
+}
+
+// queryCounter is a gorm logger counting the SQL queries run
+type queryCounter struct {
+	logger.Interface
+	queries atomic.Int64
+}
+
+func (c *queryCounter) LogMode(logger.LogLevel) logger.Interface {
+	return c
+}
+
+func (c *queryCounter) Trace(ctx context.Context, begin time.Time, fc func() (string, int64), err error) {
+	c.queries.Add(1)
+}
+
+func BenchmarkSearchUsers(b *testing.B) {
+	counter := &queryCounter{Interface: logger.Discard}
+	benchContext := *glauthContext
+	benchContext.Logger = counter
+
+	client := newTestClient(b, &benchContext)
+
+	newTestGroups(b, client, "test-bench", 970000, 3)
+
+	for _, n := range []int{10, 100} {
+		b.Run(fmt.Sprintf("users=%d", n), func(b *testing.B) {
+			prefix := fmt.Sprintf("test-bench-%d-", n)
+			for i := 0; i < n; i++ {
+				uid := 970000 + n*10 + i
+				err := client.CreateUser(&ressources.CreateUser{
+					Name:         fmt.Sprintf("%s%d", prefix, i),
+					UIDNumber:    uid,
+					PrimaryGroup: 970000,
+					OtherGroups:  []int{970001, 970002},
+					Capabilities: []*ressources.Capability{{Action: ressources.CapabilityActionSearch, Object: "*"}},
+				})
+				if err != nil {
+					b.Fatalf("Failed to create user: %v", err)
+				}
+				defer client.DeleteUser(uid)
+			}
+
+			query := &ressources.UserQuery{Name: &ressources.StringFilter{Value: prefix, Match: ressources.MatchPrefix}}
+
+			b.ResetTimer()
+			start := counter.queries.Load()
+			for i := 0; i < b.N; i++ {
+				users, err := client.SearchUsers(query)
+				if err != nil {
+					b.Fatalf("Failed to search users: %v", err)
+				}
+
+				if len(users) != n {
+					b.Fatalf("Expected %d users, got %d", n, len(users))
+				}
+			}
+			b.StopTimer()
+
+			b.ReportMetric(float64(counter.queries.Load()-start)/float64(b.N), "queries/op")
+		})
+	}
+}
+
+func TestIncludeGroups(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	newTestGroups(t, client, "test-include", 980000, 3)
+
+	err := client.AddIncludeGroup(980000, 980001)
+	if err != nil {
+		t.Fatalf("Failed to add include group: %v", err)
+	}
+
+	err = client.AddIncludeGroup(980000, 980002)
+	if err != nil {
+		t.Fatalf("Failed to add include group: %v", err)
+	}
+
+	err = client.AddIncludeGroup(980000, 980001)
+	if !errors.Is(err, glauth.ErrDuplicateIncludeGroup) {
+		t.Fatalf("Expected duplicate include group, got %v", err)
+	}
+
+	err = client.AddIncludeGroup(980000, 989999)
+	if !errors.Is(err, glauth.ErrGroupNotFound) {
+		t.Fatalf("Expected group not found, got %v", err)
+	}
+
+	included, err := client.ListIncludedGroups(980000)
+	if err != nil {
+		t.Fatalf("Failed to list included groups: %v", err)
+	}
+
+	if len(included) != 2 || included[0].GIDNumber != 980001 || included[1].GIDNumber != 980002 {
+		t.Fatalf("Expected groups 980001 and 980002, got %v", included)
+	}
+
+	parents, err := client.ListParentGroups(980001)
+	if err != nil {
+		t.Fatalf("Failed to list parent groups: %v", err)
+	}
+
+	if len(parents) != 1 || parents[0].Name != "test-include-0" {
+		t.Fatalf("Expected group test-include-0, got %v", parents)
+	}
+
+	err = client.RemoveIncludeGroup(980000, 980001)
+	if err != nil {
+		t.Fatalf("Failed to remove include group: %v", err)
+	}
+
+	err = client.RemoveIncludeGroup(980000, 980001)
+	if !errors.Is(err, glauth.ErrIncludeGroupNotFound) {
+		t.Fatalf("Expected include group not found, got %v", err)
+	}
+}
+
+func TestIncludeGroupCycles(t *testing.T) {
+	depthContext := *glauthContext
+	depthContext.MaxIncludeDepth = 2
+
+	client := newTestClient(t, &depthContext)
+
+	newTestGroups(t, client, "test-cycle", 981000, 4)
+
+	for _, ig := range [][2]int{{981000, 981001}, {981001, 981002}} {
+		err := client.AddIncludeGroup(ig[0], ig[1])
+		if err != nil {
+			t.Fatalf("Failed to add include group: %v", err)
+		}
+		defer client.RemoveIncludeGroup(ig[0], ig[1])
+	}
+
+	var cycleErr *glauth.CycleError
+	err := client.AddIncludeGroup(981002, 981000)
+	if !errors.As(err, &cycleErr) {
+		t.Fatalf("Expected a cycle error, got %v", err)
+	}
+
+	if fmt.Sprint(cycleErr.Path) != fmt.Sprint([]int{981002, 981000, 981001, 981002}) {
+		t.Fatalf("Unexpected cycle path %v", cycleErr.Path)
+	}
+
+	err = client.AddIncludeGroup(981003, 981003)
+	if !errors.Is(err, glauth.ErrIncludeCycle) {
+		t.Fatalf("Expected a cycle error, got %v", err)
+	}
+
+	var depthErr *glauth.DepthError
+	err = client.AddIncludeGroup(981002, 981003)
+	if !errors.As(err, &depthErr) {
+		t.Fatalf("Expected a depth error, got %v", err)
+	}
+
+	if fmt.Sprint(depthErr.Path) != fmt.Sprint([]int{981000, 981001, 981002, 981003}) {
+		t.Fatalf("Unexpected depth path %v", depthErr.Path)
+	}
+
+	cycles, err := client.FindIncludeCycles()
+	if err != nil {
+		t.Fatalf("Failed to find cycles: %v", err)
+	}
+
+	for _, c := range cycles {
+		if c.Path[0] >= 981000 && c.Path[0] <= 981003 {
+			t.Fatalf("Unexpected cycle %v", c.Path)
+		}
+	}
+}
+
+func TestConcurrentIncludeGroupCycle(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	// a, b, c and d with b including c and d including a: adding both a -> b and c -> d closes a cycle
+	a, b, c, d := 986000, 986001, 986002, 986003
+	newTestGroups(t, client, "test-concurrent-cycle", a, 4)
+
+	for _, ig := range [][2]int{{b, c}, {d, a}} {
+		err := client.AddIncludeGroup(ig[0], ig[1])
+		if err != nil {
+			t.Fatalf("Failed to add include group: %v", err)
+		}
+	}
+
+	for round := 0; round < 5; round++ {
+		adds := [][2]int{{a, b}, {c, d}}
+		errs := make([]error, len(adds))
+
+		var wg sync.WaitGroup
+		for i, ig := range adds {
+			wg.Add(1)
+			go func(i int, ig [2]int) {
+				defer wg.Done()
+				errs[i] = client.AddIncludeGroup(ig[0], ig[1])
+			}(i, ig)
+		}
+		wg.Wait()
+
+		var added [][2]int
+		for i, err := range errs {
+			switch {
+			case err == nil:
+				added = append(added, adds[i])
+			case !errors.Is(err, glauth.ErrIncludeCycle):
+				t.Fatalf("Failed to add include group: %v", err)
+			}
+		}
+
+		if len(added) != 1 {
+			t.Fatalf("Expected exactly one addition to succeed, got %v", added)
+		}
+
+		err := client.RemoveIncludeGroup(added[0][0], added[0][1])
+		if err != nil {
+			t.Fatalf("Failed to remove include group: %v", err)
+		}
+	}
+}
+
+func TestEffectiveGroups(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	newTestGroups(t, client, "test-effective", 982000, 4)
+
+	// 982000 includes 982001 which includes the other group 982002
+	for _, ig := range [][2]int{{982001, 982002}, {982000, 982001}} {
+		err := client.AddIncludeGroup(ig[0], ig[1])
+		if err != nil {
+			t.Fatalf("Failed to add include group: %v", err)
+		}
+	}
+
+	err := client.CreateUser(&ressources.CreateUser{
+		Name:         "test-effective",
+		UIDNumber:    982000,
+		PrimaryGroup: 982003,
+		OtherGroups:  []int{982002},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer client.DeleteUser(982000)
+
+	groups, err := client.EffectiveGroups("test-effective")
+	if err != nil {
+		t.Fatalf("Failed to get effective groups: %v", err)
+	}
+
+	var got []string
+	for _, g := range groups {
+		got = append(got, fmt.Sprint(g.GIDNumber, g.Path))
+	}
+
+	want := []string{"982003 [982003]", "982002 [982002]", "982001 [982002 982001]", "982000 [982002 982001 982000]"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("Expected %v, got %v", want, got)
+	}
+
+	member, err := client.IsMember("test-effective", 982000)
+	if err != nil || !member {
+		t.Fatalf("Expected membership of 982000, got %v, %v", member, err)
+	}
+
+	err = client.RemoveIncludeGroup(982001, 982002)
+	if err != nil {
+		t.Fatalf("Failed to remove include group: %v", err)
+	}
+
+	member, err = client.IsMember("test-effective", 982000)
+	if err != nil || member {
+		t.Fatalf("Expected no membership of 982000, got %v, %v", member, err)
+	}
+}
+
+func TestGroupMembers(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	newTestGroups(t, client, "test-members", 983000, 2)
+
+	for i := 0; i < 3; i++ {
+		uid := 983000 + i
+		err := client.CreateUser(&ressources.CreateUser{Name: fmt.Sprintf("test-members-%d", i), UIDNumber: uid, PrimaryGroup: 983001})
+		if err != nil {
+			t.Fatalf("Failed to create user: %v", err)
+		}
+		defer client.DeleteUser(uid)
+	}
+
+	err := client.AddUserToGroup("test-members-0", 983000)
+	if err != nil {
+		t.Fatalf("Failed to add user to group: %v", err)
+	}
+
+	err = client.AddUserToGroup("test-members-0", 983000)
+	if !errors.Is(err, glauth.ErrAlreadyMember) {
+		t.Fatalf("Expected already member, got %v", err)
+	}
+
+	err = client.RemoveUserFromGroup("test-members-0", 983001)
+	if !errors.Is(err, glauth.ErrRemovePrimaryGroup) {
+		t.Fatalf("Expected primary group error, got %v", err)
+	}
+
+	added, removed, err := client.SetGroupMembers(983000, []string{"test-members-1", "test-members-2"})
+	if err != nil {
+		t.Fatalf("Failed to set group members: %v", err)
+	}
+
+	if fmt.Sprint(added, removed) != "[test-members-1 test-members-2] [test-members-0]" {
+		t.Fatalf("Unexpected changes %v %v", added, removed)
+	}
+
+	_, _, err = client.SetGroupMembers(983001, []string{"test-members-0"})
+	if !errors.Is(err, glauth.ErrRemovePrimaryGroup) {
+		t.Fatalf("Expected primary group error, got %v", err)
+	}
+
+	members, err := client.ListGroupMembers(983000)
+	if err != nil {
+		t.Fatalf("Failed to list group members: %v", err)
+	}
+
+	if len(members) != 2 || members[0].Name != "test-members-1" || members[0].Primary {
+		t.Fatalf("Unexpected members %v", members)
+	}
+
+	err = client.RemoveUserFromGroup("test-members-1", 983000)
+	if err != nil {
+		t.Fatalf("Failed to remove user from group: %v", err)
+	}
+
+	err = client.RemoveUserFromGroup("test-members-1", 983000)
+	if !errors.Is(err, glauth.ErrNotMember) {
+		t.Fatalf("Expected not member, got %v", err)
+	}
+
+	members, err = client.ListGroupMembers(983001)
+	if err != nil {
+		t.Fatalf("Failed to list group members: %v", err)
+	}
+
+	if len(members) != 3 || !members[0].Primary {
+		t.Fatalf("Unexpected members %v", members)
+	}
+}
+
+func TestRenumberGroup(t *testing.T) {
+	client := newTestClient(t, glauthContext)
+
+	newTestGroups(t, client, "test-renumber", 984000, 3)
+	// 984001 is renumbered below
+	defer client.DeleteGroup(984010)
+
+	err := client.AddIncludeGroup(984001, 984000)
+	if err != nil {
+		t.Fatalf("Failed to add include group: %v", err)
+	}
+
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-renumber-0", UIDNumber: 984000, PrimaryGroup: 984000})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer client.DeleteUser(984000)
+
+	err = client.CreateUser(&ressources.CreateUser{Name: "test-renumber-1", UIDNumber: 984001, PrimaryGroup: 984002, OtherGroups: []int{984000}})
+	if err != nil {
+		t.Fatalf("Failed to create user: %v", err)
+	}
+	defer client.DeleteUser(984001)
+
+	gid := 984001
+	err = client.UpdateGroup("test-renumber-0", &ressources.UpdateGroup{GIDNumber: &gid})
+	if !errors.Is(err, glauth.ErrDuplicateGID) {
+		t.Fatalf("Expected duplicate GID, got %v", err)
+	}
+
+	gid = 984010
+	update := &ressources.UpdateGroup{GIDNumber: &gid}
+	preview, err := client.PreviewUpdateGroup("test-renumber-0", update)
+	if err != nil {
+		t.Fatalf("Failed to preview group update: %v", err)
+	}
+
+	if fmt.Sprint(preview.PrimaryUsers, preview.OtherUsers, preview.IncludeGroups) != "[test-renumber-0] [test-renumber-1] [{984001 984000}]" {
+		t.Fatalf("Unexpected preview %+v", preview)
+	}
+
+	_, err = client.GetGroupByGID(984000)
+	if err != nil {
+		t.Fatalf("Expected the preview to leave the group untouched, got %v", err)
+	}
+
+	err = client.UpdateGroup("test-renumber-0", update)
+	if err != nil {
+		t.Fatalf("Failed to update group: %v", err)
+	}
+
+	user, err := client.GetUserByName("test-renumber-0")
+	if err != nil {
+		t.Fatalf("Failed to get user: %v", err)
+	}
+
+	if user.PrimaryGroup == nil || user.PrimaryGroup.GIDNumber != 984010 {
+		t.Fatalf("Expected primary group 984010, got %v", user.PrimaryGroup)
+	}
+
+	member, err := client.IsMember("test-renumber-1", 984010)
+	if err != nil || !member {
+		t.Fatalf("Expected membership of 984010, got %v, %v", member, err)
+	}
+
+	included, err := client.ListIncludedGroups(984001)
+	if err != nil {
+		t.Fatalf("Failed to list included groups: %v", err)
+	}
+
+	if len(included) != 1 || included[0].GIDNumber != 984010 {
+		t.Fatalf("Expected group 984010, got %v", included)
+	}
+
+	name := "test-renumber-2"
+	err = client.UpdateGroup("test-renumber-0", &ressources.UpdateGroup{Name: &name})
+	if !errors.Is(err, glauth.ErrDuplicateName) {
+		t.Fatalf("Expected duplicate name, got %v", err)
+	}
+}